@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"MediaProxy/base"
+
+	"github.com/sirupsen/logrus"
+)
+
+// adminAuth 校验管理接口的访问权限：优先使用 admin-auth，未设置时使用 auth；
+// 两者都为空时只允许本机访问
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		cfg := getConfig()
+		key := cfg.AdminAuth
+		if key == "" {
+			key = cfg.Auth
+		}
+
+		if key == "" {
+			// 经过可信反向代理时按真实客户端地址判断
+			if ip := net.ParseIP(clientAddr(req)); ip == nil || !ip.IsLoopback() {
+				http.Error(w, "未设置管理密钥，仅允许本机访问", http.StatusForbidden)
+				return
+			}
+		} else {
+			cred := req.URL.Query().Get("auth")
+			if bearer := req.Header.Get("Authorization"); strings.HasPrefix(bearer, "Bearer ") {
+				cred = strings.TrimPrefix(bearer, "Bearer ")
+			}
+			if subtle.ConstantTimeCompare([]byte(cred), []byte(key)) != 1 {
+				http.Error(w, "无效的认证参数", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, req)
+	}
+}
+
+// metricsAuth /metrics 的认证：来自 metrics-allow 网段的客户端免认证，其余与管理接口相同
+func metricsAuth(next http.HandlerFunc) http.HandlerFunc {
+	admin := adminAuth(next)
+	return func(w http.ResponseWriter, req *http.Request) {
+		if ip := net.ParseIP(clientAddr(req)); ip != nil && base.ContainsIP(getConfig().metricsAllow, ip) {
+			next(w, req)
+			return
+		}
+		admin(w, req)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleListSessions GET /api/sessions
+func handleListSessions(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"count":    sessions.Count(),
+		"sessions": sessions.List(),
+	})
+}
+
+// handleKillSession DELETE /api/sessions/{id}
+func handleKillSession(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+	if !sessions.Kill(id) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "会话不存在"})
+		return
+	}
+	logrus.Infof("会话 %s 已被管理接口终止 (来自 %s)", id, req.RemoteAddr)
+	writeJSON(w, http.StatusOK, map[string]string{"id": id, "status": "killed"})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	handleUrl "net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyAuthHeader 携带认证密钥的自定义请求头
+const ProxyAuthHeader = "X-Proxy-Auth"
+
+// 认证密钥的来源，通过 auth-sources 配置启用哪些
+const (
+	authSourceQuery  = "query"  // ?auth=...
+	authSourceHeader = "header" // X-Proxy-Auth: ...
+	authSourceBearer = "bearer" // Authorization: Bearer ...
+	authSourceCookie = "cookie" // Cookie: <auth-cookie>=...
+	authSourcePath   = "path"   // /k/{key}/?url=...
+)
+
+// parseAuthSources 解析 auth-sources 参数
+func parseAuthSources(s string) (map[string]bool, error) {
+	sources := make(map[string]bool)
+	for _, item := range splitList(s) {
+		switch item {
+		case authSourceQuery, authSourceHeader, authSourceBearer, authSourceCookie, authSourcePath:
+			sources[item] = true
+		default:
+			return nil, fmt.Errorf("无效的 auth-sources 参数: %s (可选 query / header / bearer / cookie / path)", item)
+		}
+	}
+	return sources, nil
+}
+
+// authCredential 从某个来源取到的密钥，strip 将其从请求中移除，避免转发给上游
+type authCredential struct {
+	Source string
+	Value  string
+	strip  func()
+}
+
+// authCredentials 按 path、header、bearer、cookie、query 的顺序收集已启用来源中的密钥；
+// 路径前缀、X-Proxy-Auth 和认证 Cookie 专用于代理认证，总是从请求中移除，
+// Authorization 可能是发给上游的，只在密钥校验通过后移除
+func authCredentials(cfg *Config, req *http.Request) []authCredential {
+	var creds []authCredential
+	if cfg.authSources[authSourcePath] && strings.HasPrefix(req.URL.Path, "/k/") {
+		rest := strings.TrimPrefix(req.URL.Path, "/k/")
+		value, remain, _ := strings.Cut(rest, "/")
+		req.URL.Path = "/" + remain
+		req.URL.RawPath = ""
+		if value, err := handleUrl.PathUnescape(value); err == nil && value != "" {
+			creds = append(creds, authCredential{Source: authSourcePath, Value: value})
+		}
+	}
+	if cfg.authSources[authSourceHeader] {
+		if value := req.Header.Get(ProxyAuthHeader); value != "" {
+			creds = append(creds, authCredential{Source: authSourceHeader, Value: value})
+		}
+		req.Header.Del(ProxyAuthHeader)
+	}
+	if cfg.authSources[authSourceBearer] {
+		if value, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok && value != "" {
+			creds = append(creds, authCredential{Source: authSourceBearer, Value: strings.TrimSpace(value),
+				strip: func() { req.Header.Del("Authorization") }})
+		}
+	}
+	if cfg.authSources[authSourceCookie] && cfg.AuthCookie != "" {
+		if c, err := req.Cookie(cfg.AuthCookie); err == nil && c.Value != "" {
+			creds = append(creds, authCredential{Source: authSourceCookie, Value: c.Value})
+		}
+		removeCookie(req, cfg.AuthCookie)
+	}
+	if cfg.authSources[authSourceQuery] {
+		if value := req.URL.Query().Get("auth"); value != "" {
+			creds = append(creds, authCredential{Source: authSourceQuery, Value: value})
+		}
+	}
+	return creds
+}
+
+// removeCookie 从请求的 Cookie 头中删除指定名称的 Cookie
+func removeCookie(req *http.Request, name string) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			req.AddCookie(c)
+		}
+	}
+}
+
+// signedExtraParams 除 url 和 headers 外同样影响上游请求的参数，出现在签名链接中时必须一并签名，
+// 否则拿到链接的人可以追加 refresh / mirror 让代理以该密钥的身份访问任意地址
+var signedExtraParams = []string{"form", "h3", "refresh", "mirror"}
+
+// signedExtras 取出链接中需要签名的附加参数，mirror 可以重复，保留原有顺序
+func signedExtras(query handleUrl.Values) handleUrl.Values {
+	extras := handleUrl.Values{}
+	for _, name := range signedExtraParams {
+		if values := query[name]; len(values) > 0 {
+			extras[name] = values
+		}
+	}
+	return extras
+}
+
+// signURLParams 计算签名：sig = hex(HMAC-SHA256(secret, url + "\n" + headers + "\n" + exp [+ "\n" + extras]))，
+// url 和 headers 使用链接中的原始参数值（form=base64 时即 Base64 字符串），没有 headers 时为空字符串；
+// extras 为 signedExtraParams 中出现的参数按参数名排序后的查询字符串编码，都没有时不追加，与旧的签名保持一致。
+// 各字段之间用换行分隔，避免把 url 末尾的字符挪到 exp 中得到相同的签名
+func signURLParams(secret string, url string, headers string, exp string, extras handleUrl.Values) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(url + "\n" + headers + "\n" + exp))
+	if len(extras) > 0 {
+		mac.Write([]byte("\n" + extras.Encode()))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// accessError 拒绝请求的原因和对应的状态码
+type accessError struct {
+	Status  int
+	Message string
+}
+
+func (e *accessError) Error() string {
+	return e.Message
+}
+
+// writeAccessError 输出拒绝原因，err 不是 accessError 时按 401 处理
+func writeAccessError(w http.ResponseWriter, err error) {
+	status := http.StatusUnauthorized
+	var ae *accessError
+	if errors.As(err, &ae) {
+		status = ae.Status
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func unauthorized(msg string) error {
+	return &accessError{http.StatusUnauthorized, msg}
+}
+
+// authenticate 校验代理请求的认证参数，返回匹配的密钥（主密钥或无需认证时为 nil）：
+// 带有 sig 参数时按签名链接校验签名和有效期，kid 参数指定用哪个密钥签名，未指定时使用 sign-secret；
+// 否则比对 auth-sources 中各来源的密钥，可以是 -auth 主密钥或 keys-file 中的密钥（sign-only 时不再接受）；
+// auth、sign-secret 和密钥都未设置时不需要认证。校验通过的密钥会从请求中移除，不会转发给上游
+func authenticate(cfg *Config, req *http.Request) (*APIKey, error) {
+	creds := authCredentials(cfg, req)
+	query := req.URL.Query()
+	if sig := query.Get("sig"); sig != "" {
+		var key *APIKey
+		secret := cfg.SignSecret
+		if kid := query.Get("kid"); kid != "" {
+			if key = keyStore.ByLabel(kid); key == nil {
+				return nil, unauthorized("签名链接的 kid 不存在")
+			}
+			secret = key.Key
+		}
+		if secret == "" {
+			return nil, unauthorized("服务端未开启签名链接")
+		}
+		exp := query.Get("exp")
+		expUnix, err := strconv.ParseInt(exp, 10, 64)
+		if err != nil {
+			return nil, unauthorized("签名链接缺少有效的 exp 参数")
+		}
+		headers := query.Get("headers")
+		if headers == "" {
+			headers = query.Get("header")
+		}
+		expected := signURLParams(secret, query.Get("url"), headers, exp, signedExtras(query))
+		if !hmac.Equal([]byte(sig), []byte(expected)) {
+			return nil, unauthorized("签名校验失败")
+		}
+		if time.Now().Unix() > expUnix {
+			return nil, unauthorized("签名链接已过期")
+		}
+		return key, nil
+	}
+
+	if cfg.SignOnly {
+		return nil, unauthorized("仅允许使用签名链接")
+	}
+	// 使用第一个有效的密钥，其余来源中同样有效的密钥也一并移除
+	var matchedKey *APIKey
+	var matched bool
+	for _, cred := range creds {
+		var key *APIKey
+		ok := cfg.Auth != "" && subtle.ConstantTimeCompare([]byte(cred.Value), []byte(cfg.Auth)) == 1
+		if !ok {
+			key = keyStore.Lookup(cred.Value)
+			ok = key != nil
+		}
+		if !ok {
+			continue
+		}
+		if cred.strip != nil {
+			cred.strip()
+		}
+		if !matched {
+			matchedKey, matched = key, true
+		}
+	}
+	if matched {
+		return matchedKey, nil
+	}
+	if cfg.Auth != "" || keyStore.Enabled() {
+		return nil, unauthorized("无效的认证参数")
+	}
+	if cfg.SignSecret != "" {
+		return nil, unauthorized("缺少签名参数")
+	}
+	return nil, nil
+}
+
+// handleSignURL GET /api/sign?url=...&headers=...&ttl=3600&kid=label，为调试或其他客户端生成签名链接，
+// url、headers 以及 refresh / mirror 按链接中的原样传入（form=base64 时传 Base64 字符串，并同时传 form=base64），
+// 指定 kid 时用该密钥签名，链接受该密钥的限制
+func handleSignURL(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	secret := getConfig().SignSecret
+	kid := query.Get("kid")
+	if kid != "" {
+		key := keyStore.ByLabel(kid)
+		if key == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "密钥不存在"})
+			return
+		}
+		secret = key.Key
+	}
+	if secret == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "未设置 sign-secret"})
+		return
+	}
+	url := query.Get("url")
+	if url == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "缺少 url 参数"})
+		return
+	}
+	ttl := int64(3600)
+	if strTTL := query.Get("ttl"); strTTL != "" {
+		var err error
+		if ttl, err = strconv.ParseInt(strTTL, 10, 64); err != nil || ttl <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "无效的 ttl 参数"})
+			return
+		}
+	}
+	headers := query.Get("headers")
+	exp := strconv.FormatInt(time.Now().Unix()+ttl, 10)
+	extras := signedExtras(query)
+
+	params := handleUrl.Values{}
+	params.Set("url", url)
+	if headers != "" {
+		params.Set("headers", headers)
+	}
+	for name, values := range extras {
+		params[name] = values
+	}
+	if kid != "" {
+		params.Set("kid", kid)
+	}
+	params.Set("exp", exp)
+	params.Set("sig", signURLParams(secret, url, headers, exp, extras))
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"url": scheme + "://" + req.Host + "/?" + params.Encode(),
+		"exp": exp,
+	})
+}
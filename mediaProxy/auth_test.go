@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http/httptest"
+	handleUrl "net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuthenticateSignedURL(t *testing.T) {
+	const secret = "mySignKey"
+	const url = "https://example.com/video.mp4"
+	future := strconv.FormatInt(time.Now().Unix()+3600, 10)
+	past := strconv.FormatInt(time.Now().Unix()-60, 10)
+
+	// signed 按 signURLParams 生成链接参数，extra 为签名之后追加的参数
+	signed := func(exp string, params handleUrl.Values, extra handleUrl.Values) handleUrl.Values {
+		query := handleUrl.Values{"url": {url}, "exp": {exp}}
+		for name, values := range params {
+			query[name] = values
+		}
+		query.Set("sig", signURLParams(secret, url, query.Get("headers"), exp, signedExtras(query)))
+		for name, values := range extra {
+			query[name] = append(query[name], values...)
+		}
+		return query
+	}
+
+	tests := []struct {
+		name    string
+		secret  string
+		query   handleUrl.Values
+		wantErr string
+	}{
+		{"有效签名", secret, signed(future, nil, nil), ""},
+		{"带 headers", secret, signed(future, handleUrl.Values{"headers": {`{"Referer":"https://example.com"}`}}, nil), ""},
+		{"带 refresh 和 mirror", secret, signed(future, handleUrl.Values{
+			"refresh": {"https://example.com/refresh"},
+			"mirror":  {"https://a.example.com/v.mp4", "https://b.example.com/v.mp4"},
+		}, nil), ""},
+		{"签名后追加 refresh", secret, signed(future, nil, handleUrl.Values{"refresh": {"http://127.0.0.1/refresh"}}), "签名校验失败"},
+		{"签名后追加 mirror", secret, signed(future, handleUrl.Values{"mirror": {"https://a.example.com/v.mp4"}},
+			handleUrl.Values{"mirror": {"http://127.0.0.1/v.mp4"}}), "签名校验失败"},
+		{"签名后追加 form", secret, signed(future, nil, handleUrl.Values{"form": {"base64"}}), "签名校验失败"},
+		{"签名后追加 h3", secret, signed(future, nil, handleUrl.Values{"h3": {"1"}}), "签名校验失败"},
+		{"签名后追加 thread 不影响", secret, signed(future, nil, handleUrl.Values{"thread": {"4"}}), ""},
+		{"mirror 顺序改变", secret, func() handleUrl.Values {
+			q := signed(future, handleUrl.Values{"mirror": {"https://a.example.com/v.mp4", "https://b.example.com/v.mp4"}}, nil)
+			q["mirror"] = []string{q["mirror"][1], q["mirror"][0]}
+			return q
+		}(), "签名校验失败"},
+		{"url 被篡改", secret, func() handleUrl.Values {
+			q := signed(future, nil, nil)
+			q.Set("url", "https://example.com/other.mp4")
+			return q
+		}(), "签名校验失败"},
+		{"exp 被延长", secret, func() handleUrl.Values {
+			q := signed(past, nil, nil)
+			q.Set("exp", future)
+			return q
+		}(), "签名校验失败"},
+		{"已过期", secret, signed(past, nil, nil), "签名链接已过期"},
+		{"exp 无效", secret, signed("tomorrow", nil, nil), "签名链接缺少有效的 exp 参数"},
+		{"未设置 sign-secret", "", signed(future, nil, nil), "服务端未开启签名链接"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{SignSecret: tt.secret}
+			req := httptest.NewRequest("GET", "/?"+tt.query.Encode(), nil)
+			_, err := authenticate(cfg, req)
+			var got string
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.wantErr {
+				t.Errorf("authenticate() error = %q, want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,76 +1,99 @@
 package base
 
 import (
-	"context"
-	"crypto/tls"
 	"crypto/x509"
 	"github.com/go-resty/resty/v2"
 	"net"
 	"net/http"
-	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	NoRedirectClient          *resty.Client
-	NoRedirectClientWithProxy *resty.Client
-	RestyClient               *resty.Client
-	RestyClientWithProxy      *resty.Client
-	HttpClient                *http.Client
-	DnsResolverIP             string // 初始化为空字符串
-	IdleConnTimeout           = 10 * time.Second
-	dnsResolverProto          = "udp"
-	dnsResolverTimeoutMs      = 10000
+	IdleConnTimeout      = 10 * time.Second
+	dnsResolverProto     = "udp"
+	dnsResolverTimeoutMs = 10000
 )
 var UserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/87.0.4280.88 Safari/537.36"
 var DefaultTimeout = time.Second * 30
 
-func InitClient() {
-	NoRedirectClient = resty.New().SetRedirectPolicy(
-		resty.RedirectPolicyFunc(func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		}),
-	).SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
-	NoRedirectClient.SetHeader("user-agent", UserAgent)
+// Settings 上游客户端相关配置
+type Settings struct {
+	DNS           string   // 自定义 DNS 服务器，为空时使用系统配置
+	BindInterface string   // 绑定的网卡名称，使用该网卡上的全部地址作为出口
+	BindAddresses []string // 绑定的本地出口地址列表
+	IPPreference  string   // 优先使用的地址族: ipv4 / ipv6，为空则按解析顺序
+	HTTP3         bool     // 上游 https 请求优先尝试 HTTP/3，可被请求级别的 WithHTTP3 覆盖
+
+	// 上游 TLS 校验
+	TLSVerify      bool                // 是否校验上游证书，默认关闭以兼容自签名的源
+	TLSCAFiles     []string            // 额外信任的 CA 证书文件(PEM)
+	TLSSkipDomains []string            // 即使开启校验也跳过的域名，支持 *.example.com 和 .example.com
+	TLSPins        map[string][]string // 域名 -> 证书指纹，sha256/<base64 SPKI> 或 cert/<hex 证书 sha256>
+
+	// 目标地址策略，在 DNS 解析之后、建立连接之前检查，重定向的每一跳都会重新拨号，因此同样受限
+	BlockPrivate bool         // 禁止访问内网、回环、链路本地等地址，服务暴露在公网时开启
+	AllowDomains []string     // 域名白名单，非空时只允许访问这些域名
+	DenyDomains  []string     // 域名黑名单
+	ExemptCIDRs  []*net.IPNet // 例外放行的网段，即使开启了 BlockPrivate 也允许访问；只是豁免，不限制其他地址
+	DenyCIDRs    []*net.IPNet // 禁止访问的网段
+}
 
-	NoRedirectClientWithProxy = resty.New().SetRedirectPolicy(
+// Clients 按 Settings 构建的一组上游客户端，出口地址池、TLS 根证书和目标地址策略在构建后不再修改。
+// 重新加载配置时构建新的 Clients 整体替换，已经开始的会话继续使用开始时的那一组
+type Clients struct {
+	settings     Settings
+	sourceAddrs  []net.IP
+	sourceIndex  atomic.Uint32
+	tlsRootCAs   *x509.CertPool
+	chunkClients []*resty.Client
+	chunkIndex   atomic.Uint32
+
+	NoRedirectClient *resty.Client // 不跟随重定向，由调用方逐跳处理
+	RestyClient      *resty.Client
+}
+
+// NewClients 加载出口地址和 CA 证书并构建客户端，出错时不影响正在使用的 Clients
+func NewClients(s Settings) (*Clients, error) {
+	addrs, err := loadSourceAddrs(s)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := loadTLSRoots(s.TLSCAFiles)
+	if err != nil {
+		return nil, err
+	}
+	c := &Clients{settings: s, sourceAddrs: addrs, tlsRootCAs: roots}
+
+	c.NoRedirectClient = resty.New().SetRedirectPolicy(
 		resty.RedirectPolicyFunc(func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		}),
-	)
-	NoRedirectClientWithProxy.SetHeader("user-agent", UserAgent)
-	RestyClient = NewRestyClient()
-	RestyClientWithProxy = NewRestyClient()
-	HttpClient = NewHttpClient()
-}
+	).SetTransport(c.newUpstreamTransport(&http.Transport{
+		DialContext:     c.newDialContext(nil),
+		IdleConnTimeout: IdleConnTimeout,
+	}, nil))
+	// 共用的客户端不使用 resty 默认的 CookieJar，否则不同请求的 Cookie 会互相泄漏，调用方按请求自行设置 Cookie
+	c.NoRedirectClient.SetCookieJar(nil)
+	c.NoRedirectClient.SetHeader("user-agent", UserAgent)
+	c.RestyClient = c.NewRestyClient()
 
-func NewRestyClient() *resty.Client {
-	dialer := &net.Dialer{
-		// Timeout: ConnectTimeout * time.Second, // 设置连接超时为
-		Resolver: &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				d := net.Dialer{
-					Timeout: time.Duration(dnsResolverTimeoutMs) * time.Millisecond,
-				}
-				dnsAddr := DnsResolverIP
-				if dnsAddr != "" && !strings.Contains(dnsAddr, ":") {
-					dnsAddr = dnsAddr + ":53"
-				}
-				return d.DialContext(ctx, dnsResolverProto, dnsAddr)
-			},
-		},
+	// 每个出口地址一个独立的客户端（连接池），供 ProxyWorker 轮询使用
+	if len(addrs) > 1 {
+		for _, ip := range addrs {
+			c.chunkClients = append(c.chunkClients, c.newRestyClient(ip))
+		}
 	}
+	return c, nil
+}
+
+func (c *Clients) NewRestyClient() *resty.Client {
+	return c.newRestyClient(nil)
+}
 
+func (c *Clients) newRestyClient(localIP net.IP) *resty.Client {
 	transport := &http.Transport{
-		DialContext: dialer.DialContext,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-			VerifyPeerCertificate: func(certificates [][]byte, _ [][]*x509.Certificate) error {
-				// 完全忽略证书验证
-				return nil
-			},
-		},
+		DialContext:     c.newDialContext(localIP),
 		IdleConnTimeout: IdleConnTimeout,
 	}
 
@@ -78,34 +101,35 @@ func NewRestyClient() *resty.Client {
 		SetHeader("user-agent", UserAgent).
 		SetRetryCount(3).
 		SetTimeout(DefaultTimeout).
-		SetTransport(transport)
+		SetRedirectPolicy(resty.RedirectPolicyFunc(c.checkRedirect)).
+		SetTransport(c.newUpstreamTransport(transport, localIP))
 	return client
 }
 
-func NewHttpClient() *http.Client {
-	dialer := &net.Dialer{
-		// Timeout: ConnectTimeout, // 设置连接超时为
-		Resolver: &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				d := net.Dialer{
-					Timeout: time.Duration(dnsResolverTimeoutMs) * time.Millisecond,
-				}
-				dnsAddr := DnsResolverIP
-				if dnsAddr != "" && !strings.Contains(dnsAddr, ":") {
-					dnsAddr = dnsAddr + ":53"
-				}
-				return d.DialContext(ctx, dnsResolverProto, dnsAddr)
-			},
-		},
-	}
+// RequestClient 返回共用 RestyClient 连接池的客户端，CookieJar 和超时只属于这个客户端。
+// RestyClient 被所有会话共用，不能直接修改它的设置
+func (c *Clients) RequestClient(jar http.CookieJar, timeout time.Duration) *resty.Client {
+	return requestClient(c.RestyClient, jar, timeout)
+}
+
+// requestClient 基于 pooled 的 Transport 和重定向策略创建新的客户端，重试次数由调用方按需设置
+func requestClient(pooled *resty.Client, jar http.CookieJar, timeout time.Duration) *resty.Client {
+	hc := pooled.GetClient()
+	return resty.NewWithClient(&http.Client{
+		Transport:     hc.Transport,
+		CheckRedirect: hc.CheckRedirect,
+		Jar:           jar,
+		Timeout:       timeout,
+	}).SetHeader("user-agent", UserAgent)
+}
 
+func (c *Clients) NewHttpClient() *http.Client {
 	return &http.Client{
-		Timeout: time.Hour * 48,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			DialContext:     dialer.DialContext,
+		Timeout:       time.Hour * 48,
+		CheckRedirect: c.checkRedirect,
+		Transport: c.newUpstreamTransport(&http.Transport{
+			DialContext:     c.newDialContext(nil),
 			IdleConnTimeout: IdleConnTimeout,
-		},
+		}, nil),
 	}
 }
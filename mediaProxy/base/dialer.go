@@ -0,0 +1,217 @@
+package base
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+func (c *Clients) newResolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{
+				Timeout: time.Duration(dnsResolverTimeoutMs) * time.Millisecond,
+			}
+			dnsAddr := c.settings.DNS
+			if dnsAddr != "" && !strings.Contains(dnsAddr, ":") {
+				dnsAddr = dnsAddr + ":53"
+			}
+			return d.DialContext(ctx, dnsResolverProto, dnsAddr)
+		},
+	}
+}
+
+// newDialContext 返回一个按 IPPreference 排序候选地址并从 localIP 发起连接的拨号函数，
+// localIP 为 nil 时每次拨号从出口地址池中轮询选择，地址池为空则由系统选择
+func (c *Clients) newDialContext(localIP net.IP) func(ctx context.Context, network, address string) (net.Conn, error) {
+	resolver := c.newResolver()
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := c.resolveCandidates(ctx, resolver, host, localIP)
+		if err != nil {
+			return nil, err
+		}
+
+		var lastErr error
+		for _, ip := range ips {
+			src, err := c.sourceFor(localIP, ip)
+			if err != nil {
+				// 没有同族的出口地址，跳过该地址，不能退回系统默认路由
+				lastErr = err
+				continue
+			}
+			d := net.Dialer{KeepAlive: 30 * time.Second}
+			if src != nil {
+				d.LocalAddr = &net.TCPAddr{IP: src}
+			}
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, lastErr
+	}
+}
+
+// resolveCandidates 解析 host、按目标地址策略过滤并按出口地址和 IPPreference 排序，得到待连接的候选地址
+func (c *Clients) resolveCandidates(ctx context.Context, resolver *net.Resolver, host string, localIP net.IP) ([]net.IP, error) {
+	if err := c.CheckContextHost(ctx, host); err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	ips, err := c.filterDestination(host, ips)
+	if err != nil {
+		return nil, err
+	}
+	ips = c.sortByPreference(ips, localIP)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("没有可用于 %s 的地址", host)
+	}
+	return ips, nil
+}
+
+// sortByPreference 把与出口地址同族、以及 IPPreference 指定族的地址排在前面
+func (c *Clients) sortByPreference(ips []net.IP, localIP net.IP) []net.IP {
+	preferV4 := c.settings.IPPreference != "ipv6"
+	if localIP != nil {
+		preferV4 = isIPv4(localIP)
+	} else if c.settings.IPPreference == "" {
+		return ips
+	}
+	var first, rest []net.IP
+	for _, ip := range ips {
+		if isIPv4(ip) == preferV4 {
+			first = append(first, ip)
+		} else {
+			rest = append(rest, ip)
+		}
+	}
+	return append(first, rest...)
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+// loadSourceAddrs 汇总 BindAddresses 与 BindInterface 上的地址作为出口地址池
+func loadSourceAddrs(s Settings) ([]net.IP, error) {
+	var addrs []net.IP
+	for _, addr := range s.BindAddresses {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("无效的出口地址: %s", addr)
+		}
+		addrs = append(addrs, ip)
+	}
+
+	if s.BindInterface != "" {
+		iface, err := net.InterfaceByName(s.BindInterface)
+		if err != nil {
+			return nil, fmt.Errorf("找不到网卡 %s: %v", s.BindInterface, err)
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("读取网卡 %s 地址失败: %v", s.BindInterface, err)
+		}
+		for _, a := range ifaceAddrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsLoopback() {
+				continue
+			}
+			addrs = append(addrs, ipNet.IP)
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("网卡 %s 上没有可用的地址", s.BindInterface)
+		}
+	}
+
+	// 按 IPPreference 过滤出口地址，只有在过滤后仍有地址时才生效
+	if s.IPPreference == "ipv4" || s.IPPreference == "ipv6" {
+		var filtered []net.IP
+		for _, ip := range addrs {
+			if isIPv4(ip) == (s.IPPreference == "ipv4") {
+				filtered = append(filtered, ip)
+			}
+		}
+		if len(filtered) > 0 {
+			addrs = filtered
+		}
+	}
+	return addrs, nil
+}
+
+// nextSourceAddr 从出口地址池中轮询选择一个与目标同族的地址
+func (c *Clients) nextSourceAddr(v4 bool) net.IP {
+	n := len(c.sourceAddrs)
+	if n == 0 {
+		return nil
+	}
+	start := int(c.sourceIndex.Add(1) - 1)
+	for i := 0; i < n; i++ {
+		ip := c.sourceAddrs[(start+i)%n]
+		if isIPv4(ip) == v4 {
+			return ip
+		}
+	}
+	return nil
+}
+
+// sourceFor 为目标地址 ip 选择同族的出口地址：优先使用 localIP，族不同时从出口地址池中轮询选择。
+// 没有配置出口地址时返回 nil 由系统选择；配置了但没有同族地址时返回错误
+func (c *Clients) sourceFor(localIP net.IP, ip net.IP) (net.IP, error) {
+	v4 := isIPv4(ip)
+	if localIP != nil && isIPv4(localIP) == v4 {
+		return localIP, nil
+	}
+	if localIP == nil && len(c.sourceAddrs) == 0 {
+		return nil, nil
+	}
+	if src := c.nextSourceAddr(v4); src != nil {
+		return src, nil
+	}
+	return nil, fmt.Errorf("没有与目标地址 %s 同族的出口地址", ip)
+}
+
+// SourceAddrs 返回出口地址池
+func (c *Clients) SourceAddrs() []net.IP {
+	return c.sourceAddrs
+}
+
+// NextChunkClient 轮询选择绑定到不同出口地址的连接池（未配置出口地址时使用 RestyClient 的连接池），
+// 返回只给一次分片请求使用的客户端，jar 和 timeout 不会影响其他请求
+func (c *Clients) NextChunkClient(jar http.CookieJar, timeout time.Duration) *resty.Client {
+	pooled := c.RestyClient
+	if len(c.chunkClients) > 0 {
+		i := c.chunkIndex.Add(1)
+		pooled = c.chunkClients[int(i-1)%len(c.chunkClients)]
+	}
+	return requestClient(pooled, jar, timeout)
+}
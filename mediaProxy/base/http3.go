@@ -0,0 +1,168 @@
+package base
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HTTP/3 握手失败后，该主机在此时间内直接走 HTTP/2 / HTTP/1.1
+var http3RetryAfter = 10 * time.Minute
+
+var (
+	http3Broken     sync.Map // host -> time.Time
+	quicTransports  = make(map[string]*quic.Transport)
+	quicTransportMu sync.Mutex
+)
+
+type http3CtxKey struct{}
+
+// WithHTTP3 在 ctx 上标记本次请求是否使用 HTTP/3，优先级高于 Settings.HTTP3
+func WithHTTP3(ctx context.Context, enabled bool) context.Context {
+	return context.WithValue(ctx, http3CtxKey{}, enabled)
+}
+
+func http3Wanted(ctx context.Context, enabled bool) bool {
+	if v, ok := ctx.Value(http3CtxKey{}).(bool); ok {
+		return v
+	}
+	return enabled
+}
+
+// upstreamTransport 默认使用原有的 HTTP/1.1 传输；请求要求 HTTP/3 时先尝试 QUIC，
+// 失败后回退到可协商 HTTP/2 的传输（ALPN 不支持时自动降为 HTTP/1.1）
+type upstreamTransport struct {
+	tcp   *http.Transport
+	h2    *http.Transport
+	h3    *http3.Transport
+	http3 bool // 请求没有用 WithHTTP3 指定时是否尝试 HTTP/3
+}
+
+// newUpstreamTransport 由 tcp.DialContext 建立的连接在这里统一完成 TLS 握手，证书按拨号的主机校验
+func (c *Clients) newUpstreamTransport(tcp *http.Transport, localIP net.IP) *upstreamTransport {
+	tcp.DialTLSContext = c.newDialTLSContext(tcp.DialContext, nil)
+	h2 := tcp.Clone()
+	h2.ForceAttemptHTTP2 = true
+	h2.DialTLSContext = c.newDialTLSContext(tcp.DialContext, []string{"h2", "http/1.1"})
+	return &upstreamTransport{
+		tcp:   tcp,
+		h2:    h2,
+		http3: c.settings.HTTP3,
+		h3: &http3.Transport{
+			QUICConfig: &quic.Config{
+				HandshakeIdleTimeout: 3 * time.Second,
+				MaxIdleTimeout:       IdleConnTimeout * 3,
+			},
+			Dial: c.newQUICDial(localIP),
+		},
+	}
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" || !http3Wanted(req.Context(), t.http3) {
+		return t.tcp.RoundTrip(req)
+	}
+
+	host := req.URL.Host
+	if until, ok := http3Broken.Load(host); !ok || time.Now().After(until.(time.Time)) {
+		resp, err := t.h3.RoundTrip(req)
+		if err == nil {
+			http3Broken.Delete(host)
+			return resp, nil
+		}
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+		http3Broken.Store(host, time.Now().Add(http3RetryAfter))
+
+		// 带请求体的请求只有在能够重放时才回退
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, err
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+	return t.h2.RoundTrip(req)
+}
+
+func (t *upstreamTransport) CloseIdleConnections() {
+	t.tcp.CloseIdleConnections()
+	t.h2.CloseIdleConnections()
+	t.h3.CloseIdleConnections()
+}
+
+// newQUICDial 使用自定义 DNS 和出口地址建立 QUIC 连接
+func (c *Clients) newQUICDial(localIP net.IP) func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	resolver := c.newResolver()
+	return func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := c.resolveCandidates(ctx, resolver, host, localIP)
+		if err != nil {
+			return nil, err
+		}
+
+		lastErr := errors.New("没有可用的 QUIC 地址")
+		for _, ip := range ips {
+			src, err := c.sourceFor(localIP, ip)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			tr, err := quicTransportFor(src)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			conn, err := tr.DialEarly(ctx, &net.UDPAddr{IP: ip, Port: port}, c.tlsConfig(tlsCfg, host), cfg)
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, lastErr
+	}
+}
+
+// quicTransportFor 为每个出口地址复用一个 UDP socket
+func quicTransportFor(src net.IP) (*quic.Transport, error) {
+	key := ""
+	if src != nil {
+		key = src.String()
+	}
+	quicTransportMu.Lock()
+	defer quicTransportMu.Unlock()
+	if tr, ok := quicTransports[key]; ok {
+		return tr, nil
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: src})
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udpConn}
+	quicTransports[key] = tr
+	return tr, nil
+}
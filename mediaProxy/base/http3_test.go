@@ -0,0 +1,135 @@
+package base
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newTestH2Server 启动只监听 TCP 的 TLS 服务，响应内容为请求的协议版本和请求体
+func newTestH2Server(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.Proto+" "+string(body))
+	}))
+	srv.EnableHTTP2 = true
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHTTP3Fallback(t *testing.T) {
+	c, err := NewClients(Settings{HTTP3: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := c.NewHttpClient()
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		ctx        func(context.Context) context.Context
+		wantBody   string
+		wantBroken bool
+	}{
+		{"QUIC 不可用时回退到 HTTP/2", http.MethodGet, "", nil, "HTTP/2.0 ", true},
+		{"可重放的请求体随回退重新发送", http.MethodPost, "payload", nil, "HTTP/2.0 payload", true},
+		{"请求级别关闭 HTTP/3", http.MethodGet, "", func(ctx context.Context) context.Context { return WithHTTP3(ctx, false) }, "HTTP/1.1 ", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestH2Server(t)
+			ctx := context.Background()
+			if tt.ctx != nil {
+				ctx = tt.ctx(ctx)
+			}
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req, err := http.NewRequestWithContext(ctx, tt.method, srv.URL, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(got) != tt.wantBody {
+				t.Errorf("响应 = %q, want %q", got, tt.wantBody)
+			}
+			if _, broken := http3Broken.Load(req.URL.Host); broken != tt.wantBroken {
+				t.Fatalf("标记 HTTP/3 不可用 = %v, want %v", broken, tt.wantBroken)
+			}
+			if !tt.wantBroken {
+				return
+			}
+
+			// 标记后不再等待 QUIC 握手超时
+			start := time.Now()
+			resp, err = client.Get(srv.URL)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			resp.Body.Close()
+			if elapsed := time.Since(start); resp.ProtoMajor != 2 || elapsed > time.Second {
+				t.Errorf("再次请求 %s 用时 %v，应直接使用 HTTP/2", resp.Proto, elapsed)
+			}
+		})
+	}
+}
+
+func TestHTTP3Success(t *testing.T) {
+	leaf, _, key := newTestChain(t, []string{"localhost"}, []net.IP{net.ParseIP("127.0.0.1")})
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{leaf.Raw}, PrivateKey: key}},
+		}),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Proto)
+		}),
+	}
+	go srv.Serve(udpConn)
+	t.Cleanup(func() { srv.Close() })
+
+	c, err := NewClients(Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "https://" + udpConn.LocalAddr().String()
+	req, err := http.NewRequestWithContext(WithHTTP3(context.Background(), true), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	http3Broken.Store(req.URL.Host, time.Now().Add(-time.Second))
+	resp, err := c.NewHttpClient().Do(req)
+	if err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	defer resp.Body.Close()
+	got, _ := io.ReadAll(resp.Body)
+	if resp.ProtoMajor != 3 || string(got) != "HTTP/3.0" {
+		t.Errorf("协议 = %s (%q), want HTTP/3.0", resp.Proto, got)
+	}
+	if _, broken := http3Broken.Load(req.URL.Host); broken {
+		t.Error("HTTP/3 成功后应清除不可用标记")
+	}
+}
@@ -0,0 +1,150 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrDestinationBlocked 目标地址被策略禁止
+var ErrDestinationBlocked = errors.New("目标地址被安全策略禁止")
+
+// 除标准库判断之外需要额外禁止的保留网段
+var reservedCIDRs = mustParseCIDRs(
+	"0.0.0.0/8",      // 本网络
+	"100.64.0.0/10",  // 运营商级 NAT
+	"192.0.0.0/24",   // IETF 协议分配
+	"198.18.0.0/15",  // 基准测试
+	"240.0.0.0/4",    // 保留地址及广播
+	"64:ff9b::/96",   // NAT64 知名前缀，可映射到任意 IPv4 地址（包括内网地址）
+	"64:ff9b:1::/48", // NAT64 本地前缀
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := ParseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// ParseCIDRs 解析网段列表，单个 IP 视为 /32 或 /128
+func ParseCIDRs(items []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("无效的网段: %s", item)
+			}
+			bits := 128
+			if isIPv4(ip) {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("无效的网段: %s", item)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// ContainsIP 判断 ip 是否属于 nets 中的任一网段
+func ContainsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateIP 判断是否为内网、回环、链路本地（含云厂商元数据地址 169.254.169.254）等非公网地址
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || ContainsIP(reservedCIDRs, ip)
+}
+
+// CheckDestinationHost 按域名黑白名单检查目标主机
+func (c *Clients) CheckDestinationHost(host string) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if len(c.settings.DenyDomains) > 0 && MatchDomain(host, c.settings.DenyDomains) {
+		return fmt.Errorf("%w: %s 在域名黑名单中", ErrDestinationBlocked, host)
+	}
+	if len(c.settings.AllowDomains) > 0 && !MatchDomain(host, c.settings.AllowDomains) {
+		return fmt.Errorf("%w: %s 不在域名白名单中", ErrDestinationBlocked, host)
+	}
+	return nil
+}
+
+type allowedDomainsKey struct{}
+
+// WithAllowedDomains 为 ctx 下的上游请求附加额外的域名白名单（如密钥的 allowed_domains），
+// 重定向的每一跳和每次拨号都会检查，domains 为空时不限制
+func WithAllowedDomains(ctx context.Context, domains []string) context.Context {
+	if len(domains) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, allowedDomainsKey{}, domains)
+}
+
+// CheckContextHost 在 CheckDestinationHost 的基础上检查 ctx 附加的域名白名单
+func (c *Clients) CheckContextHost(ctx context.Context, host string) error {
+	if err := c.CheckDestinationHost(host); err != nil {
+		return err
+	}
+	if domains, ok := ctx.Value(allowedDomainsKey{}).([]string); ok {
+		if !MatchDomain(strings.TrimSuffix(strings.ToLower(host), "."), domains) {
+			return fmt.Errorf("%w: %s 不在密钥允许的域名中", ErrDestinationBlocked, host)
+		}
+	}
+	return nil
+}
+
+// checkDestinationIP 按网段策略检查解析后的地址：DenyCIDRs 优先，ExemptCIDRs 中的地址不受 BlockPrivate 限制
+func (c *Clients) checkDestinationIP(ip net.IP) bool {
+	if ContainsIP(c.settings.DenyCIDRs, ip) {
+		return false
+	}
+	if ContainsIP(c.settings.ExemptCIDRs, ip) {
+		return true
+	}
+	return !c.settings.BlockPrivate || !isPrivateIP(ip)
+}
+
+// filterDestination 过滤掉被策略禁止的地址，全部被禁止时返回错误
+func (c *Clients) filterDestination(host string, ips []net.IP) ([]net.IP, error) {
+	if !c.settings.BlockPrivate && len(c.settings.ExemptCIDRs) == 0 && len(c.settings.DenyCIDRs) == 0 {
+		return ips, nil
+	}
+	allowed := ips[:0:0]
+	for _, ip := range ips {
+		if c.checkDestinationIP(ip) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("%w: %s 解析到的地址 %v 不允许访问", ErrDestinationBlocked, host, ips)
+	}
+	return allowed, nil
+}
+
+// checkRedirect 重定向时检查每一跳的域名，地址在拨号时检查
+func (c *Clients) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("重定向次数过多")
+	}
+	return c.CheckContextHost(req.Context(), req.URL.Hostname())
+}
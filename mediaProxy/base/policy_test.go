@@ -0,0 +1,77 @@
+package base
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestCheckDestinationIP(t *testing.T) {
+	exempt := mustParseCIDRs("192.168.1.10", "fd00::/64")
+	deny := mustParseCIDRs("203.0.113.0/24", "192.168.1.10/32")
+
+	tests := []struct {
+		name string
+		s    Settings
+		ip   string
+		want bool
+	}{
+		{"未开启时允许内网", Settings{}, "10.0.0.1", true},
+		{"公网地址", Settings{BlockPrivate: true}, "93.184.216.34", true},
+		{"内网地址", Settings{BlockPrivate: true}, "192.168.1.1", false},
+		{"回环地址", Settings{BlockPrivate: true}, "127.0.0.1", false},
+		{"IPv6 回环", Settings{BlockPrivate: true}, "::1", false},
+		{"云厂商元数据地址", Settings{BlockPrivate: true}, "169.254.169.254", false},
+		{"运营商级 NAT", Settings{BlockPrivate: true}, "100.64.0.1", false},
+		{"未指定地址", Settings{BlockPrivate: true}, "0.0.0.0", false},
+		{"IPv4 映射的内网地址", Settings{BlockPrivate: true}, "::ffff:10.0.0.1", false},
+		{"IPv6 唯一本地地址", Settings{BlockPrivate: true}, "fd00::1", false},
+		{"IPv6 公网地址", Settings{BlockPrivate: true}, "2606:4700::1111", true},
+
+		{"NAT64 映射的元数据地址", Settings{BlockPrivate: true}, "64:ff9b::a9fe:a9fe", false},
+		{"NAT64 映射的内网地址", Settings{BlockPrivate: true}, "64:ff9b::c0a8:101", false},
+		{"NAT64 映射的公网地址同样禁止", Settings{BlockPrivate: true}, "64:ff9b::5db8:d822", false},
+		{"NAT64 本地前缀", Settings{BlockPrivate: true}, "64:ff9b:1::a00:1", false},
+		{"未开启时允许 NAT64", Settings{}, "64:ff9b::a9fe:a9fe", true},
+
+		{"例外放行的内网地址", Settings{BlockPrivate: true, ExemptCIDRs: exempt}, "192.168.1.10", true},
+		{"例外放行的 IPv6 网段", Settings{BlockPrivate: true, ExemptCIDRs: exempt}, "fd00::10", true},
+		{"例外网段之外的内网地址", Settings{BlockPrivate: true, ExemptCIDRs: exempt}, "192.168.1.11", false},
+		{"例外网段不限制公网地址", Settings{BlockPrivate: true, ExemptCIDRs: exempt}, "93.184.216.34", true},
+		{"未开启时例外网段不限制内网地址", Settings{ExemptCIDRs: exempt}, "10.0.0.1", true},
+
+		{"禁止的网段", Settings{DenyCIDRs: deny}, "203.0.113.5", false},
+		{"禁止优先于例外放行", Settings{BlockPrivate: true, ExemptCIDRs: exempt, DenyCIDRs: deny}, "192.168.1.10", false},
+		{"禁止的网段之外", Settings{DenyCIDRs: deny}, "198.51.100.1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := net.ParseIP(tt.ip)
+			if ip == nil {
+				t.Fatalf("无效的测试地址 %s", tt.ip)
+			}
+			c := &Clients{settings: tt.s}
+			if got := c.checkDestinationIP(ip); got != tt.want {
+				t.Errorf("checkDestinationIP(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterDestination(t *testing.T) {
+	c := &Clients{settings: Settings{BlockPrivate: true}}
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("93.184.216.34"), net.ParseIP("64:ff9b::a00:1")}
+
+	got, err := c.filterDestination("mixed.example.com", ips)
+	if err != nil || len(got) != 1 || !got[0].Equal(ips[1]) {
+		t.Errorf("filterDestination() = %v, %v, want [%v]", got, err, ips[1])
+	}
+	if len(ips) != 3 {
+		t.Errorf("filterDestination() 修改了传入的地址列表: %v", ips)
+	}
+
+	_, err = c.filterDestination("internal.example.com", ips[:1])
+	if !errors.Is(err, ErrDestinationBlocked) {
+		t.Errorf("filterDestination() error = %v, want ErrDestinationBlocked", err)
+	}
+}
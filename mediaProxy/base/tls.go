@@ -0,0 +1,173 @@
+package base
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// loadTLSRoots 加载系统根证书和 caFiles 中的额外 CA
+func loadTLSRoots(caFiles []string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	for _, file := range caFiles {
+		file = strings.TrimSpace(file)
+		if file == "" {
+			continue
+		}
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("读取 CA 文件 %s 失败: %v", file, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA 文件 %s 中没有有效的证书", file)
+		}
+	}
+	return pool, nil
+}
+
+// ParseTLSPins 解析 "域名=指纹|指纹,域名=指纹" 格式的证书指纹配置
+func ParseTLSPins(s string) (map[string][]string, error) {
+	pins := make(map[string][]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		domain, values, ok := strings.Cut(entry, "=")
+		if !ok || domain == "" || values == "" {
+			return nil, fmt.Errorf("无效的证书指纹配置: %s", entry)
+		}
+		for _, pin := range strings.Split(values, "|") {
+			if !strings.HasPrefix(pin, "sha256/") && !strings.HasPrefix(pin, "cert/") {
+				return nil, fmt.Errorf("无效的证书指纹 %s，应以 sha256/ 或 cert/ 开头", pin)
+			}
+			pins[strings.ToLower(domain)] = append(pins[strings.ToLower(domain)], pin)
+		}
+	}
+	return pins, nil
+}
+
+// MatchDomain 判断 host 是否命中规则列表，规则支持完整域名、*.example.com 和 .example.com
+func MatchDomain(host string, rules []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if rule == "" {
+			continue
+		}
+		if rule == "*" || rule == host {
+			return true
+		}
+		suffix := strings.TrimPrefix(rule, "*")
+		if strings.HasPrefix(suffix, ".") && strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsConfig 返回连接 host 时使用的 TLS 配置，base 为 nil 时从空配置开始。
+// 内置校验被关闭，改由 verifyConnection 按拨号时的 host 决定是否校验证书链以及证书指纹：
+// host 为 IP 时不发送 SNI，握手结果中的 ServerName 为空，不能用来校验
+func (c *Clients) tlsConfig(base *tls.Config, host string) *tls.Config {
+	cfg := &tls.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		return c.verifyConnection(host, cs)
+	}
+	return cfg
+}
+
+// newDialTLSContext 用 dial 建立连接后完成 TLS 握手，nextProtos 为 ALPN 协商的协议，为空时只使用 HTTP/1.1
+func (c *Clients) newDialTLSContext(dial func(ctx context.Context, network, addr string) (net.Conn, error), nextProtos []string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, c.tlsConfig(&tls.Config{NextProtos: nextProtos}, host))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// verifyConnection 按 host 校验上游证书，host 为 IP 时与证书中的 IP SAN 比较
+func (c *Clients) verifyConnection(host string, cs tls.ConnectionState) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("上游没有提供证书")
+	}
+
+	if c.settings.TLSVerify && !MatchDomain(host, c.settings.TLSSkipDomains) {
+		if host == "" {
+			// DNSName 为空时 x509 不校验主机名
+			return errors.New("上游证书校验失败: 无法确定上游主机名")
+		}
+		opts := x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         c.tlsRootCAs,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+			return fmt.Errorf("上游证书校验失败(%s): %v", host, err)
+		}
+	}
+
+	pins := c.lookupPins(host)
+	if len(pins) == 0 {
+		return nil
+	}
+	for _, cert := range cs.PeerCertificates {
+		spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		der := sha256.Sum256(cert.Raw)
+		for _, pin := range pins {
+			if pin == "sha256/"+base64.StdEncoding.EncodeToString(spki[:]) ||
+				strings.EqualFold(pin, "cert/"+hex.EncodeToString(der[:])) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("上游证书指纹不匹配(%s)", host)
+}
+
+func (c *Clients) lookupPins(host string) []string {
+	if len(c.settings.TLSPins) == 0 {
+		return nil
+	}
+	if pins, ok := c.settings.TLSPins[host]; ok {
+		return pins
+	}
+	for domain, pins := range c.settings.TLSPins {
+		if MatchDomain(host, []string{domain}) {
+			return pins
+		}
+	}
+	return nil
+}
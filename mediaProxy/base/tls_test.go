@@ -0,0 +1,174 @@
+package base
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestChain 生成自签名 CA 和由它签发的证书，证书包含 dnsNames 和 ips 两类 SAN
+func newTestChain(t *testing.T, dnsNames []string, ips []net.IP) (leaf *x509.Certificate, ca *x509.Certificate, leafKey *ecdsa.PrivateKey) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca, err = x509.ParseCertificate(caDER); err != nil {
+		t.Fatal(err)
+	}
+
+	leafKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "upstream"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf, err = x509.ParseCertificate(leafDER); err != nil {
+		t.Fatal(err)
+	}
+	return leaf, ca, leafKey
+}
+
+func TestVerifyConnection(t *testing.T) {
+	leaf, ca, _ := newTestChain(t, []string{"cdn.example.com"}, []net.IP{net.ParseIP("203.0.113.10"), net.ParseIP("2001:db8::10")})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca}}
+
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	caSPKI := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	der := sha256.Sum256(leaf.Raw)
+	spkiPin := "sha256/" + base64.StdEncoding.EncodeToString(spki[:])
+	caPin := "sha256/" + base64.StdEncoding.EncodeToString(caSPKI[:])
+	certPin := "cert/" + strings.ToUpper(hex.EncodeToString(der[:]))
+	wrongPin := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	tests := []struct {
+		name    string
+		s       Settings
+		host    string
+		wantErr bool
+	}{
+		{"不校验时接受任何主机", Settings{}, "other.example.net", false},
+		{"域名匹配", Settings{TLSVerify: true}, "cdn.example.com", false},
+		{"域名大小写和末尾的点", Settings{TLSVerify: true}, "CDN.Example.com.", false},
+		{"域名不匹配", Settings{TLSVerify: true}, "pan.example.com", true},
+		{"IP 直连匹配 IP SAN", Settings{TLSVerify: true}, "203.0.113.10", false},
+		{"IPv6 直连匹配 IP SAN", Settings{TLSVerify: true}, "2001:db8::10", false},
+		{"IP 直连不在证书中", Settings{TLSVerify: true}, "203.0.113.11", true},
+		{"IP 直连不能用域名 SAN 通过", Settings{TLSVerify: true}, "198.51.100.1", true},
+		{"主机为空时拒绝", Settings{TLSVerify: true}, "", true},
+		{"跳过校验的域名", Settings{TLSVerify: true, TLSSkipDomains: []string{"*.example.net"}}, "pan.example.net", false},
+
+		{"SPKI 指纹匹配", Settings{TLSPins: map[string][]string{"cdn.example.com": {wrongPin, spkiPin}}}, "cdn.example.com", false},
+		{"中间证书指纹匹配", Settings{TLSPins: map[string][]string{"cdn.example.com": {caPin}}}, "cdn.example.com", false},
+		{"证书指纹大小写不敏感", Settings{TLSPins: map[string][]string{"cdn.example.com": {certPin}}}, "cdn.example.com", false},
+		{"指纹不匹配", Settings{TLSPins: map[string][]string{"cdn.example.com": {wrongPin}}}, "cdn.example.com", true},
+		{"通配符域名的指纹", Settings{TLSPins: map[string][]string{"*.example.com": {wrongPin}}}, "cdn.example.com", true},
+		{"其他域名的指纹不生效", Settings{TLSPins: map[string][]string{"pan.example.com": {wrongPin}}}, "cdn.example.com", false},
+		{"IP 直连按 IP 查找指纹", Settings{TLSPins: map[string][]string{"203.0.113.10": {wrongPin}}}, "203.0.113.10", true},
+		{"跳过校验的域名仍检查指纹", Settings{TLSVerify: true, TLSSkipDomains: []string{"cdn.example.com"},
+			TLSPins: map[string][]string{"cdn.example.com": {wrongPin}}}, "cdn.example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Clients{settings: tt.s, tlsRootCAs: roots}
+			if err := c.verifyConnection(tt.host, state); (err != nil) != tt.wantErr {
+				t.Errorf("verifyConnection(%q) error = %v, wantErr %v", tt.host, err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("没有证书", func(t *testing.T) {
+		c := &Clients{}
+		if err := c.verifyConnection("cdn.example.com", tls.ConnectionState{}); err == nil {
+			t.Error("verifyConnection() 没有证书时应返回错误")
+		}
+	})
+}
+
+// TestTLSVerifyIPLiteral IP 直连时不发送 SNI，必须按拨号的地址校验证书
+func TestTLSVerifyIPLiteral(t *testing.T) {
+	tests := []struct {
+		name    string
+		ips     []net.IP
+		host    string
+		wantErr bool
+	}{
+		{"IP 在证书中", []net.IP{net.ParseIP("127.0.0.1")}, "127.0.0.1", false},
+		{"证书中没有这个 IP", nil, "127.0.0.1", true},
+		{"证书中是其他 IP", []net.IP{net.ParseIP("127.0.0.2")}, "127.0.0.1", true},
+		{"域名匹配", nil, "localhost", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leaf, ca, key := newTestChain(t, []string{"localhost"}, tt.ips)
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			srv.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{leaf.Raw}, PrivateKey: key}}}
+			srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+			srv.StartTLS()
+			defer srv.Close()
+
+			caFile := filepath.Join(t.TempDir(), "ca.pem")
+			if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			c, err := NewClients(Settings{TLSVerify: true, TLSCAFiles: []string{caFile}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+			url := "https://" + net.JoinHostPort(tt.host, port)
+			resp, err := c.NewHttpClient().Get(url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get(%q) error = %v, wantErr %v", url, err, tt.wantErr)
+			}
+			if err == nil {
+				resp.Body.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"MediaProxy/base"
+)
+
+// clientACL 客户端地址访问控制，由 allow-client / deny-client / lan-only / trusted-proxy 生成
+type clientACL struct {
+	LanOnly bool
+	Allow   []*net.IPNet
+	Deny    []*net.IPNet
+	Trusted []*net.IPNet // 可信的反向代理，只有来自这些地址的 X-Forwarded-For 才会被采用
+}
+
+func newClientACL(cfg *Config) (*clientACL, error) {
+	acl := &clientACL{LanOnly: cfg.LanOnly}
+	var err error
+	if acl.Allow, err = base.ParseCIDRs(splitList(cfg.AllowClient)); err != nil {
+		return nil, err
+	}
+	if acl.Deny, err = base.ParseCIDRs(splitList(cfg.DenyClient)); err != nil {
+		return nil, err
+	}
+	if acl.Trusted, err = base.ParseCIDRs(splitList(cfg.TrustedProxy)); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func (a *clientACL) trusted(ip net.IP) bool {
+	return base.ContainsIP(a.Trusted, ip)
+}
+
+// clientIP 返回真实的客户端地址：直连地址是可信代理时，从右向左解析 X-Forwarded-For，
+// 跳过可信代理，第一个不可信的地址即为客户端；无法解析时返回 nil
+func (a *clientACL) clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !a.trusted(ip) {
+		return ip
+	}
+	var hops []string
+	for _, value := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !a.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// allowed 按规则检查客户端地址：deny-client 优先；
+// 设置了 lan-only 或 allow-client 时，只接受局域网地址（lan-only）或 allow-client 中的地址
+func (a *clientACL) allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if base.ContainsIP(a.Deny, ip) {
+		return false
+	}
+	if !a.LanOnly && len(a.Allow) == 0 {
+		return true
+	}
+	if a.LanOnly && isLanIP(ip) {
+		return true
+	}
+	return base.ContainsIP(a.Allow, ip)
+}
+
+// isLanIP 局域网客户端：RFC1918 / IPv6 ULA、回环和链路本地地址
+func isLanIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+}
+
+// clientAddr 返回请求的真实客户端地址，用于日志和会话信息
+func clientAddr(req *http.Request) string {
+	if info := getRequestInfo(req.Context()); info != nil && info.ClientIP != "" {
+		return info.ClientIP
+	}
+	return req.RemoteAddr
+}
+
+// withClientACL 在所有处理之前检查客户端地址，被拒绝的请求返回 403 并记录日志
+func withClientACL(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		acl := getConfig().acl
+		ip := acl.clientIP(req)
+		if info := getRequestInfo(req.Context()); info != nil && ip != nil {
+			info.ClientIP = ip.String()
+		}
+		if !acl.allowed(ip) {
+			requestLogger(req.Context()).Warnf("拒绝来自 %s 的访问: 客户端地址不在允许范围内 (直连地址 %s)", ip, req.RemoteAddr)
+			http.Error(w, "客户端地址不允许访问", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	acl, err := newClientACL(&Config{TrustedProxy: "127.0.0.1, 10.0.0.0/8, fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"直连客户端", "203.0.113.5:51000", nil, "203.0.113.5"},
+		{"不可信的地址伪造 X-Forwarded-For", "203.0.113.5:51000", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"可信代理没有 X-Forwarded-For", "127.0.0.1:51000", nil, "127.0.0.1"},
+		{"可信代理转发", "127.0.0.1:51000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"客户端伪造的最左侧地址被忽略", "127.0.0.1:51000", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"跳过多层可信代理", "127.0.0.1:51000", []string{"198.51.100.1, 10.0.0.2, 10.0.0.3"}, "198.51.100.1"},
+		{"多个 X-Forwarded-For 头", "127.0.0.1:51000", []string{"1.1.1.1", "198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"全部是可信代理时取最左侧", "127.0.0.1:51000", []string{"10.0.0.2, 10.0.0.3"}, "10.0.0.2"},
+		{"无法解析的地址之前停止", "127.0.0.1:51000", []string{"198.51.100.1, unknown, 10.0.0.2"}, "10.0.0.2"},
+		{"IPv6 可信代理", "[fd00::1]:51000", []string{"2001:db8::5"}, "2001:db8::5"},
+		{"没有端口的直连地址", "203.0.113.5", nil, "203.0.113.5"},
+		{"无法解析的直连地址", "@unix", nil, "<nil>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			for _, value := range tt.xff {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if got := acl.clientIP(req).String(); got != tt.want {
+				t.Errorf("clientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("未设置可信代理", func(t *testing.T) {
+		acl, _ := newClientACL(&Config{})
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "127.0.0.1:51000"
+		req.Header.Set("X-Forwarded-For", "198.51.100.1")
+		if got := acl.clientIP(req).String(); got != "127.0.0.1" {
+			t.Errorf("clientIP() = %s, want 127.0.0.1", got)
+		}
+	})
+}
+
+func TestClientACLAllowed(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		ip   string
+		want bool
+	}{
+		{"未设置规则", Config{}, "203.0.113.5", true},
+		{"局域网模式允许内网", Config{LanOnly: true}, "192.168.1.5", true},
+		{"局域网模式允许回环", Config{LanOnly: true}, "::1", true},
+		{"局域网模式拒绝公网", Config{LanOnly: true}, "203.0.113.5", false},
+		{"允许列表内", Config{AllowClient: "203.0.113.0/24"}, "203.0.113.5", true},
+		{"允许列表外", Config{AllowClient: "203.0.113.0/24"}, "198.51.100.1", false},
+		{"允许列表和局域网模式同时生效", Config{LanOnly: true, AllowClient: "203.0.113.5"}, "203.0.113.5", true},
+		{"拒绝列表", Config{DenyClient: "203.0.113.5"}, "203.0.113.5", false},
+		{"拒绝优先于局域网模式", Config{LanOnly: true, DenyClient: "192.168.1.0/24"}, "192.168.1.5", false},
+		{"拒绝优先于允许列表", Config{AllowClient: "203.0.113.0/24", DenyClient: "203.0.113.5"}, "203.0.113.5", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl, err := newClientACL(&tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := acl.allowed(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("allowed(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("无法解析的地址", func(t *testing.T) {
+		acl, _ := newClientACL(&Config{})
+		if acl.allowed(nil) {
+			t.Error("allowed(nil) = true, want false")
+		}
+	})
+}
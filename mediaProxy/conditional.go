@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// conditionalHeaderNames 条件请求头，由代理按缓存的校验值在本地处理，不转发给上游，
+// 否则上游返回的 304 / 412 会被当成探测或分片请求失败
+var conditionalHeaderNames = []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"}
+
+// conditions 客户端请求中的条件请求头
+type conditions struct {
+	IfMatch           string
+	IfNoneMatch       string
+	IfModifiedSince   string
+	IfUnmodifiedSince string
+	IfRange           string
+}
+
+// takeConditions 取出条件请求头并从请求中删除
+func takeConditions(req *http.Request) conditions {
+	c := conditions{
+		IfMatch:           req.Header.Get("If-Match"),
+		IfNoneMatch:       req.Header.Get("If-None-Match"),
+		IfModifiedSince:   req.Header.Get("If-Modified-Since"),
+		IfUnmodifiedSince: req.Header.Get("If-Unmodified-Since"),
+		IfRange:           req.Header.Get("If-Range"),
+	}
+	for _, name := range conditionalHeaderNames {
+		req.Header.Del(name)
+	}
+	return c
+}
+
+// conditionResult 条件请求的处理结果
+type conditionResult int
+
+const (
+	conditionPass        conditionResult = iota // 正常响应
+	conditionNotModified                        // 304
+	conditionFailed                             // 412
+	conditionIgnoreRange                        // If-Range 不匹配，忽略 Range 返回完整内容
+)
+
+// evaluate 按 RFC 7232 第 6 节的顺序，用上游的 ETag / Last-Modified 判断条件请求
+func (c conditions) evaluate(method string, hasRange bool, headers http.Header) conditionResult {
+	etag := headers.Get("ETag")
+	lastModified := headers.Get("Last-Modified")
+
+	if c.IfMatch != "" {
+		if !matchETags(c.IfMatch, etag, false) {
+			return conditionFailed
+		}
+	} else if c.IfUnmodifiedSince != "" {
+		if modified, ok := modifiedSince(lastModified, c.IfUnmodifiedSince); ok && modified {
+			return conditionFailed
+		}
+	}
+
+	isGet := method == http.MethodGet || method == http.MethodHead
+	if c.IfNoneMatch != "" {
+		if matchETags(c.IfNoneMatch, etag, true) {
+			if isGet {
+				return conditionNotModified
+			}
+			return conditionFailed
+		}
+	} else if c.IfModifiedSince != "" && isGet {
+		if modified, ok := modifiedSince(lastModified, c.IfModifiedSince); ok && !modified {
+			return conditionNotModified
+		}
+	}
+
+	if c.IfRange != "" && hasRange && method == http.MethodGet && !c.rangeValid(etag, lastModified) {
+		return conditionIgnoreRange
+	}
+	return conditionPass
+}
+
+// rangeValid If-Range 可以是 ETag（强比较）或日期（必须与 Last-Modified 完全相同）
+func (c conditions) rangeValid(etag string, lastModified string) bool {
+	if strings.HasPrefix(c.IfRange, `"`) || strings.HasPrefix(c.IfRange, "W/") {
+		return matchETags(c.IfRange, etag, false)
+	}
+	if lastModified == "" {
+		return false
+	}
+	t1, err1 := http.ParseTime(c.IfRange)
+	t2, err2 := http.ParseTime(lastModified)
+	return err1 == nil && err2 == nil && t1.Equal(t2)
+}
+
+// modifiedSince 判断 lastModified 是否晚于 since，任一时间无法解析时 ok 为 false
+func modifiedSince(lastModified string, since string) (modified bool, ok bool) {
+	if lastModified == "" {
+		return false, false
+	}
+	t, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false, false
+	}
+	s, err := http.ParseTime(since)
+	if err != nil {
+		return false, false
+	}
+	return t.Truncate(time.Second).After(s), true
+}
+
+// matchETags 判断 ETag 列表中是否有与 etag 匹配的值，weak 为 true 时使用弱比较；
+// * 匹配任何存在的资源，探测成功即表示资源存在
+func matchETags(list string, etag string, weak bool) bool {
+	list = strings.TrimSpace(list)
+	if list == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	for _, tag := range splitETags(list) {
+		if etagEqual(tag, etag, weak) {
+			return true
+		}
+	}
+	return false
+}
+
+// etagEqual 强比较要求两者都不是弱校验值且完全相同，弱比较忽略 W/ 前缀
+func etagEqual(a string, b string, weak bool) bool {
+	if weak {
+		return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+	}
+	return !strings.HasPrefix(a, "W/") && !strings.HasPrefix(b, "W/") && a == b
+}
+
+// splitETags 拆分逗号分隔的 ETag 列表，引号内的逗号不作为分隔符
+func splitETags(list string) []string {
+	var tags []string
+	for {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			return tags
+		}
+		start := 0
+		if strings.HasPrefix(list, "W/") {
+			start = 2
+		}
+		if len(list) <= start || list[start] != '"' {
+			return tags
+		}
+		end := strings.IndexByte(list[start+1:], '"')
+		if end < 0 {
+			return tags
+		}
+		end += start + 2
+		tags = append(tags, list[:end])
+		list = list[end:]
+	}
+}
+
+// apply 处理条件请求：已经输出 304 / 412 时 done 为 true，If-Range 不匹配时 ignoreRange 为 true
+func (c conditions) apply(w http.ResponseWriter, method string, hasRange bool, headers http.Header) (done bool, ignoreRange bool) {
+	switch c.evaluate(method, hasRange, headers) {
+	case conditionNotModified:
+		writeNotModified(w, headers)
+		return true, false
+	case conditionFailed:
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return true, false
+	case conditionIgnoreRange:
+		return false, true
+	}
+	return false, false
+}
+
+// writeNotModified 输出 304，只带校验和缓存相关的头
+func writeNotModified(w http.ResponseWriter, headers http.Header) {
+	for _, name := range []string{"ETag", "Last-Modified", "Content-Location", "Expires", "Vary"} {
+		if v := headers.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// validatorsChanged 判断上游响应的 ETag / Last-Modified 是否与已知的不同，任一方缺失时不比较
+func validatorsChanged(known http.Header, current http.Header) bool {
+	for _, name := range []string{"ETag", "Last-Modified"} {
+		a, b := known.Get(name), current.Get(name)
+		if a != "" && b != "" && a != b {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidateHeaders 删除 scope 下缓存的头信息和重定向终点，下一个请求会重新探测
+func invalidateHeaders(scope string) {
+	mediaCache.Delete(scope + "#Headers")
+	mediaCache.Delete(scope + "#LastModified")
+	mediaCache.Delete(redirectKey(scope))
+}
+
+// fileValidators 探测时记录的文件校验值，每个分片响应都必须与之一致
+type fileValidators struct {
+	ETag         string
+	LastModified string
+	Size         int64 // 文件总大小，0 表示不校验
+}
+
+func newFileValidators(headers http.Header, size int64) fileValidators {
+	return fileValidators{
+		ETag:         headers.Get("ETag"),
+		LastModified: headers.Get("Last-Modified"),
+		Size:         size,
+	}
+}
+
+// check 比较分片响应与探测结果，响应中缺失的校验值不比较
+func (v fileValidators) check(status int, headers http.Header) error {
+	if etag := headers.Get("ETag"); v.ETag != "" && etag != "" && etag != v.ETag {
+		return fmt.Errorf("ETag 由 %s 变为 %s", v.ETag, etag)
+	}
+	if lm := headers.Get("Last-Modified"); v.LastModified != "" && lm != "" && lm != v.LastModified {
+		return fmt.Errorf("Last-Modified 由 %s 变为 %s", v.LastModified, lm)
+	}
+	if v.Size <= 0 {
+		return nil
+	}
+	var total string
+	switch status {
+	case http.StatusPartialContent:
+		if i := strings.LastIndexByte(headers.Get("Content-Range"), '/'); i >= 0 {
+			total = headers.Get("Content-Range")[i+1:]
+		}
+	case http.StatusOK:
+		total = headers.Get("Content-Length")
+	}
+	if size, err := strconv.ParseInt(strings.TrimSpace(total), 10, 64); err == nil && size != v.Size {
+		return fmt.Errorf("文件大小由 %d 变为 %d", v.Size, size)
+	}
+	return nil
+}
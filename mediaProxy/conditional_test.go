@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestConditionsEvaluate(t *testing.T) {
+	const (
+		lastModified = "Tue, 14 Nov 2023 22:13:20 GMT"
+		earlier      = "Mon, 13 Nov 2023 22:13:20 GMT"
+		later        = "Wed, 15 Nov 2023 22:13:20 GMT"
+	)
+	strong := http.Header{"Etag": {`"v1"`}, "Last-Modified": {lastModified}}
+	weak := http.Header{"Etag": {`W/"v1"`}, "Last-Modified": {lastModified}}
+
+	tests := []struct {
+		name     string
+		cond     conditions
+		method   string
+		hasRange bool
+		headers  http.Header
+		want     conditionResult
+	}{
+		{"没有条件", conditions{}, http.MethodGet, false, strong, conditionPass},
+
+		{"If-Match 强匹配", conditions{IfMatch: `"v1"`}, http.MethodGet, false, strong, conditionPass},
+		{"If-Match 列表中匹配", conditions{IfMatch: `"v0", "v1"`}, http.MethodGet, false, strong, conditionPass},
+		{"If-Match 不匹配", conditions{IfMatch: `"v2"`}, http.MethodGet, false, strong, conditionFailed},
+		{"If-Match 弱 ETag 不能强比较", conditions{IfMatch: `W/"v1"`}, http.MethodGet, false, weak, conditionFailed},
+		{"If-Match *", conditions{IfMatch: "*"}, http.MethodGet, false, http.Header{}, conditionPass},
+		{"If-Match 上游没有 ETag", conditions{IfMatch: `"v1"`}, http.MethodGet, false, http.Header{}, conditionFailed},
+
+		{"If-Unmodified-Since 之后修改过", conditions{IfUnmodifiedSince: earlier}, http.MethodGet, false, strong, conditionFailed},
+		{"If-Unmodified-Since 未修改", conditions{IfUnmodifiedSince: later}, http.MethodGet, false, strong, conditionPass},
+		{"If-Match 优先于 If-Unmodified-Since", conditions{IfMatch: `"v1"`, IfUnmodifiedSince: earlier}, http.MethodGet, false, strong, conditionPass},
+
+		{"If-None-Match 弱比较匹配", conditions{IfNoneMatch: `"v1"`}, http.MethodGet, false, weak, conditionNotModified},
+		{"If-None-Match 带 W/ 匹配强 ETag", conditions{IfNoneMatch: `W/"v1"`}, http.MethodHead, false, strong, conditionNotModified},
+		{"If-None-Match 不匹配", conditions{IfNoneMatch: `"v2"`}, http.MethodGet, false, strong, conditionPass},
+		{"If-None-Match 非 GET 匹配时失败", conditions{IfNoneMatch: "*"}, http.MethodPut, false, strong, conditionFailed},
+		{"If-None-Match 优先于 If-Modified-Since", conditions{IfNoneMatch: `"v2"`, IfModifiedSince: later}, http.MethodGet, false, strong, conditionPass},
+
+		{"If-Modified-Since 未修改", conditions{IfModifiedSince: lastModified}, http.MethodGet, false, strong, conditionNotModified},
+		{"If-Modified-Since 之后修改过", conditions{IfModifiedSince: earlier}, http.MethodGet, false, strong, conditionPass},
+		{"If-Modified-Since 无法解析", conditions{IfModifiedSince: "yesterday"}, http.MethodGet, false, strong, conditionPass},
+		{"If-Modified-Since 只用于 GET", conditions{IfModifiedSince: later}, http.MethodPost, false, strong, conditionPass},
+
+		{"If-Range ETag 匹配", conditions{IfRange: `"v1"`}, http.MethodGet, true, strong, conditionPass},
+		{"If-Range ETag 不匹配", conditions{IfRange: `"v2"`}, http.MethodGet, true, strong, conditionIgnoreRange},
+		{"If-Range 弱 ETag 不匹配", conditions{IfRange: `W/"v1"`}, http.MethodGet, true, weak, conditionIgnoreRange},
+		{"If-Range 日期相同", conditions{IfRange: lastModified}, http.MethodGet, true, strong, conditionPass},
+		{"If-Range 日期不同", conditions{IfRange: later}, http.MethodGet, true, strong, conditionIgnoreRange},
+		{"If-Range 没有 Range 时忽略", conditions{IfRange: `"v2"`}, http.MethodGet, false, strong, conditionPass},
+		{"If-Range 只用于 GET", conditions{IfRange: `"v2"`}, http.MethodHead, true, strong, conditionPass},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cond.evaluate(tt.method, tt.hasRange, tt.headers); got != tt.want {
+				t.Errorf("evaluate(%s, %v) = %d, want %d", tt.method, tt.hasRange, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitETags(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+		want []string
+	}{
+		{"单个", `"abc"`, []string{`"abc"`}},
+		{"多个", `"a", "b",W/"c"`, []string{`"a"`, `"b"`, `W/"c"`}},
+		{"引号内的逗号", `"a,b", "c"`, []string{`"a,b"`, `"c"`}},
+		{"多余的分隔符", ` , "a",,	"b" `, []string{`"a"`, `"b"`}},
+		{"空列表", "", nil},
+		{"缺少引号时停止", `"a", b, "c"`, []string{`"a"`}},
+		{"未闭合的引号", `"a", "b`, []string{`"a"`}},
+		{"只有 W/", `W/`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitETags(tt.list); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitETags(%q) = %q, want %q", tt.list, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"MediaProxy/base"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// 环境变量前缀，MEDIAPROXY_BIND_ADDR 对应 -bind-addr
+const envPrefix = "MEDIAPROXY_"
+
+// errBadArgs 命令行参数解析失败，错误信息和用法已经由 flag 输出
+var errBadArgs = errors.New("命令行参数错误")
+
+// Config 运行配置。配置文件的键名与命令行参数同名（也可用下划线），
+// 优先级：命令行参数 > 环境变量 > 配置文件 > 默认值
+type Config struct {
+	ConfigFile string
+
+	Port        string
+	DNS         string
+	Debug       bool
+	Auth        string
+	AdminAuth   string
+	SignSecret  string
+	SignOnly    bool
+	AuthSources string
+	AuthCookie  string
+	KeysFile    string
+	UsageFile   string
+	GuessType   bool
+
+	// 日志
+	LogFormat     string
+	LogFile       string
+	LogMaxSize    int64
+	LogMaxBackups int
+	AccessLog     bool
+
+	// 指标
+	MetricsAllow string
+	metricsAllow []*net.IPNet
+
+	// 链路追踪
+	TraceEndpoint string
+	TraceSample   float64
+
+	// 上游连接
+	BindInterface  string
+	BindAddresses  string
+	PreferIP       string
+	HTTP3          bool
+	TLSVerify      string
+	TLSCAFiles     string
+	TLSSkipDomains string
+	TLSPins        string
+
+	// 目标地址策略
+	Exposed     bool
+	AllowDomain string
+	DenyDomain  string
+	ExemptCIDR  string
+	DenyCIDR    string
+	clients     *base.Clients // 按上游连接和目标地址策略构建，会话开始时随 cfg 一起取得，之后不受重新加载影响
+
+	// 客户端访问控制
+	LanOnly      bool
+	AllowClient  string
+	DenyClient   string
+	TrustedProxy string
+	acl          *clientACL
+	authSources  map[string]bool
+
+	// 落盘
+	SpoolDir       string
+	SpoolTTL       int64
+	SpoolMaxSize   int64
+	SpoolTotalSize int64
+
+	// 探测
+	ProbeStrategies string
+	probeStrategies []string
+
+	// 上游主机限流与熔断
+	HostMaxInflight      int
+	HostRPS              float64
+	HostBreakerThreshold int
+	HostBreakerCooldown  int64
+
+	// 监听
+	TLSCert       string
+	TLSKey        string
+	TLSSelfSigned bool
+	TLSPort       string
+	H2C           bool
+
+	// 调优参数
+	ProxyTimeout     int64 // ProxyRead 等待分片的超时(秒)
+	ChunkTimeout     int64 // 单个分片请求的超时(秒)
+	MaxThreads       int64 // thread 参数的上限
+	MaxBufferSize    int64 // 单个会话最多缓冲的数据量
+	FirstChunkSize   int64 // 首个分片的大小，用于降低首包延迟
+	DefaultChunkSize int64 // 未指定 size 时的分片大小
+	MaxRetries       int   // 分片请求的重试次数
+	MaxRetriesHead   int   // 文件开头和结尾分片的重试次数
+
+	ShowHelp    bool
+	ShowVersion bool
+}
+
+var currentConfig atomic.Pointer[Config]
+
+// getConfig 返回当前生效的配置快照，新会话开始时获取一次，热重载不影响进行中的会话
+func getConfig() *Config {
+	return currentConfig.Load()
+}
+
+// sizeFlag 支持 K/M/G 单位的字节数参数
+type sizeFlag struct{ value *int64 }
+
+func (f sizeFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return formatSize(*f.value)
+}
+
+func (f sizeFlag) Set(s string) error {
+	v, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*f.value = v
+	return nil
+}
+
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "B")
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1024
+	case strings.HasSuffix(s, "M"):
+		unit = 1024 * 1024
+	case strings.HasSuffix(s, "G"):
+		unit = 1024 * 1024 * 1024
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("无效的大小: %s", s)
+	}
+	return v * unit, nil
+}
+
+func formatSize(v int64) string {
+	switch {
+	case v >= 1024*1024 && v%(1024*1024) == 0:
+		return fmt.Sprintf("%dM", v/(1024*1024))
+	case v >= 1024 && v%1024 == 0:
+		return fmt.Sprintf("%dK", v/1024)
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+// newFlagSet 注册所有参数并绑定到 cfg，参数名同时也是配置文件的键名和环境变量名
+func newFlagSet(cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	fs.StringVar(&cfg.ConfigFile, "config", "", "配置文件路径(YAML/JSON)，键名与参数名相同，收到 SIGHUP 或文件变化时热重载")
+	fs.StringVar(&cfg.DNS, "dns", "8.8.8.8", "DNS解析 IP:port")
+	fs.StringVar(&cfg.Port, "port", "5575", "服务器端口")
+	fs.BoolVar(&cfg.Debug, "debug", false, "Debug模式")
+	fs.StringVar(&cfg.Auth, "auth", "", "认证密钥")
+	fs.StringVar(&cfg.AdminAuth, "admin-auth", "", "管理接口(/api/*)的认证密钥，为空时使用 auth，两者都为空时仅允许本机访问")
+	fs.StringVar(&cfg.MetricsAllow, "metrics-allow", "", "允许免认证访问 /metrics 的客户端网段（如 Docker 中的 Prometheus），多个用逗号分隔")
+	fs.StringVar(&cfg.SignSecret, "sign-secret", "", "签名链接的 HMAC 密钥，设置后接受带 exp 和 sig 参数的签名链接")
+	fs.BoolVar(&cfg.SignOnly, "sign-only", false, "只接受签名链接，不再接受明文 auth 参数")
+	fs.StringVar(&cfg.AuthSources, "auth-sources", "query,header,bearer,cookie,path", "接受认证密钥的来源: query(?auth=) / header(X-Proxy-Auth) / bearer(Authorization) / cookie / path(/k/{key}/)，多个用逗号分隔")
+	fs.StringVar(&cfg.AuthCookie, "auth-cookie", "mediaproxy_auth", "携带认证密钥的 Cookie 名称")
+	fs.StringVar(&cfg.KeysFile, "keys-file", "", "多密钥文件 (YAML/JSON)，每个密钥可单独限制会话数、线程数、带宽、月流量和域名")
+	fs.StringVar(&cfg.UsageFile, "usage-file", "", "密钥用量保存文件，默认为密钥文件同目录下的 <名称>.usage.json")
+	fs.BoolVar(&cfg.GuessType, "guess-type", false, "是否根据URL强制猜测并设置 Content-Type (可能导致 MPV 等播放器拖拽失败，默认不启用)")
+	fs.StringVar(&cfg.LogFormat, "log-format", "text", "日志格式: text / json")
+	fs.StringVar(&cfg.LogFile, "log-file", "", "日志文件路径，为空时输出到标准输出，文件按大小自动轮转")
+	cfg.LogMaxSize = 10 * 1024 * 1024
+	fs.Var(sizeFlag{&cfg.LogMaxSize}, "log-max-size", "单个日志文件的最大大小，超过后轮转，支持 M 单位")
+	fs.IntVar(&cfg.LogMaxBackups, "log-max-backups", 3, "保留的历史日志文件数量")
+	fs.BoolVar(&cfg.AccessLog, "access-log", true, "每个请求结束后输出一行访问日志")
+	fs.StringVar(&cfg.TraceEndpoint, "trace-endpoint", "", "OTLP/HTTP collector 地址，如 127.0.0.1:4318，为空时不开启链路追踪")
+	fs.Float64Var(&cfg.TraceSample, "trace-sample", 1, "链路追踪采样率 (0~1)")
+	fs.StringVar(&cfg.BindInterface, "bind-iface", "", "上游请求绑定的网卡名称，使用该网卡上的全部地址作为出口")
+	fs.StringVar(&cfg.BindAddresses, "bind-addr", "", "上游请求绑定的本地出口地址，多个地址用逗号分隔，分片请求会轮询使用")
+	fs.StringVar(&cfg.PreferIP, "prefer-ip", "", "优先使用的地址族: ipv4 / ipv6")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", "", "HTTPS 证书文件")
+	fs.StringVar(&cfg.TLSKey, "tls-key", "", "HTTPS 私钥文件")
+	fs.BoolVar(&cfg.TLSSelfSigned, "tls-self-signed", false, "自动生成自签名证书提供 HTTPS；同时指定 -tls-cert/-tls-key 且文件不存在时会写入该路径")
+	fs.StringVar(&cfg.TLSPort, "tls-port", "", "HTTPS 端口，指定后 HTTP 与 HTTPS 同时监听，否则 HTTPS 替代 -port 上的 HTTP")
+	fs.BoolVar(&cfg.H2C, "h2c", false, "HTTP 端口支持明文 HTTP/2 (h2c)")
+	fs.BoolVar(&cfg.HTTP3, "http3", false, "上游 https 请求优先尝试 HTTP/3 (QUIC)，失败自动回退到 HTTP/2 / HTTP/1.1")
+	fs.StringVar(&cfg.TLSVerify, "tls-verify", "off", "上游证书校验模式: off 不校验(兼容自签名源) / on 校验证书链")
+	fs.StringVar(&cfg.TLSCAFiles, "tls-ca", "", "额外信任的 CA 证书文件(PEM)，多个文件用逗号分隔")
+	fs.StringVar(&cfg.TLSSkipDomains, "tls-skip", "", "开启校验时仍跳过校验的域名，多个用逗号分隔，支持 *.example.com")
+	fs.StringVar(&cfg.TLSPins, "tls-pin", "", "证书指纹，格式 域名=sha256/<SPKI base64>|cert/<证书sha256 hex>，多个域名用逗号分隔")
+	fs.BoolVar(&cfg.Exposed, "exposed", false, "服务暴露在公网：禁止代理访问内网、回环、链路本地和云厂商元数据等地址")
+	fs.StringVar(&cfg.AllowDomain, "allow-domain", "", "只允许代理访问的域名，多个用逗号分隔，支持 *.example.com")
+	fs.StringVar(&cfg.DenyDomain, "deny-domain", "", "禁止代理访问的域名，多个用逗号分隔，支持 *.example.com")
+	fs.StringVar(&cfg.ExemptCIDR, "exempt-cidr", "", "例外放行的网段（如局域网 NAS），开启 -exposed 时仍允许访问，不限制其他地址，多个用逗号分隔")
+	fs.StringVar(&cfg.DenyCIDR, "deny-cidr", "", "禁止代理访问的网段，多个用逗号分隔")
+	fs.StringVar(&cfg.SpoolDir, "spool-dir", "", "不支持 Range 的上游响应落盘到该目录，之后的拖动请求从已下载的部分响应，为空时不落盘")
+	fs.Int64Var(&cfg.SpoolTTL, "spool-ttl", 300, "落盘文件空闲多久后删除(秒)")
+	cfg.SpoolMaxSize = 4 * 1024 * 1024 * 1024
+	fs.Var(sizeFlag{&cfg.SpoolMaxSize}, "spool-max-size", "单个落盘文件的最大大小，超过时直接转发不落盘，0 表示不限制，支持 M/G 单位")
+	cfg.SpoolTotalSize = 16 * 1024 * 1024 * 1024
+	fs.Var(sizeFlag{&cfg.SpoolTotalSize}, "spool-total-size", "全部落盘文件合计的最大大小，超过时删除最久未使用的空闲文件，仍然不够则直接转发不落盘，0 表示不限制，支持 M/G 单位")
+	fs.StringVar(&cfg.ProbeStrategies, "probe-strategies", "range,head,open,full", "获取上游头信息的探测方式及顺序: range(bytes=0-1023) / head / open(bytes=0-) / full(完整 GET)，多个用逗号分隔，每个主机会记住上次成功的方式")
+	fs.IntVar(&cfg.HostMaxInflight, "host-max-inflight", 0, "每个上游主机同时进行的请求数上限，所有会话共享，0 表示不限制")
+	fs.Float64Var(&cfg.HostRPS, "host-rps", 0, "每个上游主机每秒最多发起的请求数，所有会话共享，0 表示不限制")
+	fs.IntVar(&cfg.HostBreakerThreshold, "host-breaker-threshold", 0, "10 秒内上游主机返回 429/503 或连接失败达到该次数时熔断，0 表示不启用")
+	fs.Int64Var(&cfg.HostBreakerCooldown, "host-breaker-cooldown", 5, "熔断后的冷却时间(秒)，连续熔断时加倍，最长 5 分钟")
+	fs.BoolVar(&cfg.LanOnly, "lan-only", false, "只接受局域网客户端 (RFC1918 / 回环 / 链路本地地址)")
+	fs.StringVar(&cfg.AllowClient, "allow-client", "", "允许访问的客户端网段，设置后只接受这些地址（与 -lan-only 同时使用时额外放行），多个用逗号分隔")
+	fs.StringVar(&cfg.DenyClient, "deny-client", "", "禁止访问的客户端网段，优先于允许规则，多个用逗号分隔")
+	fs.StringVar(&cfg.TrustedProxy, "trusted-proxy", "", "可信的反向代理地址，来自这些地址的请求按 X-Forwarded-For 识别真实客户端，多个用逗号分隔")
+
+	// 调优参数
+	cfg.MaxBufferSize = 128 * 1024 * 1024
+	cfg.FirstChunkSize = 256 * 1024
+	cfg.DefaultChunkSize = 128 * 1024
+	fs.Int64Var(&cfg.ProxyTimeout, "proxy-timeout", 10, "等待分片数据的超时时间(秒)")
+	fs.Int64Var(&cfg.ChunkTimeout, "chunk-timeout", 30, "单个分片请求的超时时间(秒)")
+	fs.Int64Var(&cfg.MaxThreads, "max-threads", 32, "thread 参数允许的最大线程数，防止被网盘封禁")
+	fs.Var(sizeFlag{&cfg.MaxBufferSize}, "max-buffer", "单个会话最多缓冲的数据量，支持 K/M/G 单位")
+	fs.Var(sizeFlag{&cfg.FirstChunkSize}, "first-chunk", "首个分片的大小，缩小首包以降低起播延迟，支持 K/M 单位")
+	fs.Var(sizeFlag{&cfg.DefaultChunkSize}, "chunk-size", "未指定 size 参数时的分片大小，支持 K/M 单位")
+	fs.IntVar(&cfg.MaxRetries, "retries", 5, "分片请求失败的重试次数")
+	fs.IntVar(&cfg.MaxRetriesHead, "retries-head", 10, "文件开头和结尾分片的重试次数")
+
+	// 帮助和版本信息
+	fs.BoolVar(&cfg.ShowHelp, "h", false, "显示帮助信息")
+	fs.BoolVar(&cfg.ShowHelp, "help", false, "显示帮助信息")
+	fs.BoolVar(&cfg.ShowVersion, "v", false, "显示版本信息")
+	fs.BoolVar(&cfg.ShowVersion, "version", false, "显示版本信息")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "drpyS专用多线程媒体代理服务 %s\n\n", AppVersion)
+		fmt.Fprintf(os.Stderr, "用法:\n")
+		fmt.Fprintf(os.Stderr, "  %s [参数]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "参数列表:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n所有参数都可以通过配置文件或 %s 前缀的环境变量设置，例如 %sBIND_ADDR\n", envPrefix, envPrefix)
+	}
+	return fs
+}
+
+// loadConfig 依次应用默认值、配置文件、环境变量和命令行参数
+func loadConfig(args []string) (*Config, error) {
+	cfg := &Config{}
+	fs := newFlagSet(cfg)
+	if err := fs.Parse(args); err != nil {
+		return nil, errBadArgs
+	}
+	visited := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { visited[f.Name] = true })
+
+	set := func(name, value, source string) error {
+		if visited[name] {
+			return nil
+		}
+		if fs.Lookup(name) == nil {
+			logrus.Warnf("%s 中的未知配置项: %s", source, name)
+			return nil
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s 中的配置项 %s 无效: %v", source, name, err)
+		}
+		return nil
+	}
+
+	if cfg.ConfigFile == "" {
+		cfg.ConfigFile = os.Getenv(envPrefix + "CONFIG")
+	}
+	if cfg.ConfigFile != "" {
+		values, err := readConfigFile(cfg.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range values {
+			if err := set(name, value, cfg.ConfigFile); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		key := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(key); ok && envErr == nil {
+			envErr = set(f.Name, value, "环境变量")
+		}
+	})
+	if envErr != nil {
+		return nil, envErr
+	}
+	return cfg, nil
+}
+
+// readConfigFile 读取配置文件，数组会被拼接为逗号分隔的字符串
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取配置文件失败: %v", err)
+	}
+	raw := make(map[string]interface{})
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &raw)
+	} else {
+		err = yaml.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("解析配置文件 %s 失败: %v", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		name := strings.ReplaceAll(strings.ToLower(key), "_", "-")
+		switch v := value.(type) {
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = strings.Join(items, ",")
+		case float64:
+			values[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case nil:
+			values[name] = ""
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+func splitList(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// clientKey 汇总影响上游客户端的配置，变化时才需要重建客户端
+func (c *Config) clientKey() string {
+	return strings.Join([]string{c.DNS, c.BindInterface, c.BindAddresses, c.PreferIP, strconv.FormatBool(c.HTTP3),
+		c.TLSVerify, c.TLSCAFiles, c.TLSSkipDomains, c.TLSPins,
+		strconv.FormatBool(c.Exposed), c.AllowDomain, c.DenyDomain, c.ExemptCIDR, c.DenyCIDR}, "\x00")
+}
+
+func (c *Config) serverOptions() ServerOptions {
+	return ServerOptions{
+		Port:       c.Port,
+		TLSPort:    c.TLSPort,
+		CertFile:   c.TLSCert,
+		KeyFile:    c.TLSKey,
+		SelfSigned: c.TLSSelfSigned,
+		H2C:        c.H2C,
+	}
+}
+
+// applyConfig 校验配置并设置到各个组件，成功后作为当前配置生效
+func applyConfig(cfg *Config) error {
+	switch cfg.PreferIP {
+	case "", "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("无效的 prefer-ip 参数: %s (可选 ipv4 / ipv6)", cfg.PreferIP)
+	}
+	var tlsVerify bool
+	switch cfg.TLSVerify {
+	case "off", "false", "":
+	case "on", "true":
+		tlsVerify = true
+	default:
+		return fmt.Errorf("无效的 tls-verify 参数: %s (可选 off / on)", cfg.TLSVerify)
+	}
+	var pins map[string][]string
+	if cfg.TLSPins != "" {
+		var err error
+		if pins, err = base.ParseTLSPins(cfg.TLSPins); err != nil {
+			return err
+		}
+	}
+	exemptCIDRs, err := base.ParseCIDRs(splitList(cfg.ExemptCIDR))
+	if err != nil {
+		return err
+	}
+	denyCIDRs, err := base.ParseCIDRs(splitList(cfg.DenyCIDR))
+	if err != nil {
+		return err
+	}
+	if cfg.metricsAllow, err = base.ParseCIDRs(splitList(cfg.MetricsAllow)); err != nil {
+		return err
+	}
+	if cfg.acl, err = newClientACL(cfg); err != nil {
+		return err
+	}
+	if cfg.authSources, err = parseAuthSources(cfg.AuthSources); err != nil {
+		return err
+	}
+	if cfg.probeStrategies, err = parseProbeStrategies(cfg.ProbeStrategies); err != nil {
+		return err
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return fmt.Errorf("tls-cert 和 tls-key 需要同时设置")
+	}
+	if cfg.SignOnly && cfg.SignSecret == "" {
+		return fmt.Errorf("sign-only 需要同时设置 sign-secret")
+	}
+	if cfg.ProxyTimeout <= 0 || cfg.ChunkTimeout <= 0 || cfg.MaxThreads <= 0 ||
+		cfg.FirstChunkSize <= 0 || cfg.DefaultChunkSize <= 0 || cfg.MaxRetries <= 0 || cfg.MaxRetriesHead <= 0 {
+		return fmt.Errorf("超时、线程数、分片大小和重试次数必须大于 0")
+	}
+	if cfg.SpoolDir != "" && cfg.SpoolTTL <= 0 {
+		return fmt.Errorf("spool-ttl 必须大于 0")
+	}
+	if cfg.HostMaxInflight < 0 || cfg.HostRPS < 0 || cfg.HostBreakerThreshold < 0 {
+		return fmt.Errorf("host-max-inflight、host-rps 和 host-breaker-threshold 不能小于 0")
+	}
+	if cfg.HostBreakerThreshold > 0 && cfg.HostBreakerCooldown <= 0 {
+		return fmt.Errorf("host-breaker-cooldown 必须大于 0")
+	}
+	if cfg.MaxBufferSize < cfg.DefaultChunkSize {
+		return fmt.Errorf("max-buffer 不能小于 chunk-size")
+	}
+
+	// 先构建好客户端、校验日志、密钥和链路追踪的配置，全部成功后才修改各个组件，任何一步失败时保持原来的配置
+	old := getConfig()
+	if old != nil && old.clientKey() == cfg.clientKey() {
+		cfg.clients = old.clients
+	} else {
+		if cfg.clients, err = base.NewClients(base.Settings{
+			DNS:            cfg.DNS,
+			BindInterface:  cfg.BindInterface,
+			BindAddresses:  splitList(cfg.BindAddresses),
+			IPPreference:   cfg.PreferIP,
+			HTTP3:          cfg.HTTP3,
+			TLSVerify:      tlsVerify,
+			TLSCAFiles:     splitList(cfg.TLSCAFiles),
+			TLSSkipDomains: splitList(cfg.TLSSkipDomains),
+			TLSPins:        pins,
+			BlockPrivate:   cfg.Exposed,
+			AllowDomains:   splitList(cfg.AllowDomain),
+			DenyDomains:    splitList(cfg.DenyDomain),
+			ExemptCIDRs:    exemptCIDRs,
+			DenyCIDRs:      denyCIDRs,
+		}); err != nil {
+			return fmt.Errorf("初始化客户端失败: %v", err)
+		}
+	}
+	applyLog, err := prepareLogSettings(logSettings{
+		Format:     cfg.LogFormat,
+		File:       cfg.LogFile,
+		MaxSize:    cfg.LogMaxSize,
+		MaxBackups: cfg.LogMaxBackups,
+	})
+	if err != nil {
+		return err
+	}
+	applyKeys, err := keyStore.Prepare(cfg.KeysFile, cfg.UsageFile)
+	if err != nil {
+		return err
+	}
+	// 链路追踪会创建 provider，放在最后
+	applyTrace, err := prepareTracing(traceSettings{
+		Endpoint:   cfg.TraceEndpoint,
+		SampleRate: cfg.TraceSample,
+	})
+	if err != nil {
+		return err
+	}
+
+	applyLog()
+	applyKeys()
+	applyTrace()
+	if cfg.Debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	} else {
+		logrus.SetLevel(logrus.InfoLevel)
+	}
+	if old == nil || cfg.clients != old.clients {
+		if addrs := cfg.clients.SourceAddrs(); len(addrs) > 0 {
+			logrus.Infof("上游出口地址: %v", addrs)
+		}
+	}
+
+	if old != nil && old.serverOptions() != cfg.serverOptions() {
+		logrus.Warn("监听相关的配置(port/tls-*/h2c)已修改，需要重启才能生效")
+	}
+
+	currentConfig.Store(cfg)
+	return nil
+}
+
+// watchConfig 在收到 SIGHUP 或配置文件变化时重新加载配置，只影响之后的新会话
+func watchConfig(args []string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var lastMod time.Time
+	if path := getConfig().ConfigFile; path != "" {
+		if info, err := os.Stat(path); err == nil {
+			lastMod = info.ModTime()
+		}
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+			logrus.Info("收到 SIGHUP，重新加载配置")
+		case <-ticker.C:
+			path := getConfig().ConfigFile
+			if path == "" {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil || !info.ModTime().After(lastMod) {
+				continue
+			}
+			lastMod = info.ModTime()
+			logrus.Infof("配置文件 %s 已变化，重新加载配置", path)
+		}
+
+		cfg, err := loadConfig(args)
+		if err == nil {
+			err = applyConfig(cfg)
+		}
+		if err != nil {
+			logrus.Errorf("重新加载配置失败，继续使用旧配置: %v", err)
+			continue
+		}
+		logrus.Infof("配置已重新加载: %s", cfg.summary())
+	}
+}
+
+func (c *Config) summary() string {
+	return strings.Join([]string{
+		fmt.Sprintf("proxy-timeout=%d", c.ProxyTimeout),
+		fmt.Sprintf("chunk-timeout=%d", c.ChunkTimeout),
+		fmt.Sprintf("max-threads=%d", c.MaxThreads),
+		fmt.Sprintf("max-buffer=%s", formatSize(c.MaxBufferSize)),
+		fmt.Sprintf("first-chunk=%s", formatSize(c.FirstChunkSize)),
+		fmt.Sprintf("chunk-size=%s", formatSize(c.DefaultChunkSize)),
+		fmt.Sprintf("retries=%d/%d", c.MaxRetries, c.MaxRetriesHead),
+	}, ", ")
+}
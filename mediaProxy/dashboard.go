@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxRecentErrors 仪表盘保留的最近错误条数
+const maxRecentErrors = 50
+
+var urlPattern = regexp.MustCompile(`https?://[^\s,"]+`)
+
+// RecentError 仪表盘展示的一条警告或错误日志
+type RecentError struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// recentErrorHook 记录最近的警告和错误日志，日志中的地址会脱敏
+type recentErrorHook struct {
+	mutex  sync.Mutex
+	errors []RecentError
+}
+
+var recentErrors = &recentErrorHook{}
+
+func init() {
+	logrus.AddHook(recentErrors)
+}
+
+func (h *recentErrorHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel}
+}
+
+func (h *recentErrorHook) Fire(entry *logrus.Entry) error {
+	e := RecentError{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: urlPattern.ReplaceAllStringFunc(entry.Message, redactURL),
+	}
+	if id, ok := entry.Data["request_id"].(string); ok {
+		e.RequestID = id
+	}
+	h.mutex.Lock()
+	h.errors = append(h.errors, e)
+	if len(h.errors) > maxRecentErrors {
+		h.errors = h.errors[len(h.errors)-maxRecentErrors:]
+	}
+	h.mutex.Unlock()
+	return nil
+}
+
+// List 返回最近的错误，最新的在前
+func (h *recentErrorHook) List() []RecentError {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	list := make([]RecentError, len(h.errors))
+	for i, e := range h.errors {
+		list[len(h.errors)-1-i] = e
+	}
+	return list
+}
+
+// DashboardSnapshot 仪表盘每秒推送的运行状态
+type DashboardSnapshot struct {
+	Time          time.Time     `json:"time"`
+	Version       string        `json:"version"`
+	Uptime        float64       `json:"uptime"`
+	Goroutines    int           `json:"goroutines"`
+	Sessions      []SessionInfo `json:"sessions"`
+	BufferedBytes int64         `json:"buffered_bytes"`
+	BytesIn       int64         `json:"bytes_in"`
+	BytesOut      int64         `json:"bytes_out"`
+	CacheItems    int           `json:"cache_items"`
+	CacheHitRatio float64       `json:"cache_hit_ratio"`
+	RecentErrors  []RecentError `json:"recent_errors"`
+}
+
+var startTime = time.Now()
+
+func dashboardSnapshot() DashboardSnapshot {
+	return DashboardSnapshot{
+		Time:          time.Now(),
+		Version:       AppVersion,
+		Uptime:        time.Since(startTime).Seconds(),
+		Goroutines:    runtime.NumGoroutine(),
+		Sessions:      sessions.List(),
+		BufferedBytes: sessions.BufferedBytes(),
+		BytesIn:       int64(counterValue(metricBytesIn)),
+		BytesOut:      int64(counterValue(metricBytesOut)),
+		CacheItems:    mediaCache.ItemCount(),
+		CacheHitRatio: cacheHitRatio(),
+		RecentErrors:  recentErrors.List(),
+	}
+}
+
+// handleDashboardEvents GET /api/events，通过 SSE 每秒推送一次运行状态；
+// 浏览器的 EventSource 无法设置请求头，认证密钥通过 auth 查询参数传递
+func handleDashboardEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "不支持流式响应", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		data, err := json.Marshal(dashboardSnapshot())
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: status\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	handleUrl "net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"MediaProxy/base"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	breakerWindow      = 10 * time.Second // 统计失败次数的时间窗口
+	breakerMaxCooldown = 5 * time.Minute  // 连续熔断时冷却时间加倍的上限
+	hostLimiterIdle    = 10 * time.Minute // 主机空闲多久后释放它的限制状态
+)
+
+// circuitOpenError 上游主机处于熔断冷却中
+type circuitOpenError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("上游 %s 已熔断，%v 后恢复", e.Host, time.Until(e.Until).Round(time.Second))
+}
+
+// hostLimiter 一个上游主机在整个进程内共享的并发、频率限制和熔断状态，
+// 多个用户同时访问同一个网盘时合计不超过限制，避免整个出口 IP 被封禁
+type hostLimiter struct {
+	host string
+
+	mutex     sync.Mutex
+	inflight  int
+	released  chan struct{} // 每次释放后关闭并替换，用于唤醒等待并发名额的请求
+	nextSlot  time.Time     // 下一个请求最早可以发出的时间
+	failures  []time.Time   // 窗口内的失败时间
+	trips     int           // 连续熔断次数，决定冷却时间
+	openUntil time.Time
+	lastUsed  time.Time // 最后一次取用的时间，由 hostLimiterStore.mutex 保护
+}
+
+// idle 没有进行中的请求、不在熔断和限速状态，且空闲时间超过 hostLimiterIdle，可以释放
+func (l *hostLimiter) idle(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.inflight == 0 && now.After(l.openUntil.Add(breakerMaxCooldown)) && now.After(l.nextSlot) &&
+		(len(l.failures) == 0 || now.Sub(l.failures[len(l.failures)-1]) > breakerWindow)
+}
+
+// hostLimiterStore 按主机保存限制状态。主机来自客户端传入的地址，数量没有上限，空闲的由 janitor 定期清理
+type hostLimiterStore struct {
+	mutex    sync.Mutex
+	limiters map[string]*hostLimiter
+	once     sync.Once
+}
+
+var hostLimits = &hostLimiterStore{limiters: make(map[string]*hostLimiter)}
+
+func (s *hostLimiterStore) get(host string) *hostLimiter {
+	s.once.Do(func() { go s.janitor() })
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	l := s.limiters[host]
+	if l == nil {
+		l = &hostLimiter{host: host, released: make(chan struct{})}
+		s.limiters[host] = l
+	}
+	l.lastUsed = time.Now()
+	return l
+}
+
+// janitor 定期清理空闲的主机
+func (s *hostLimiterStore) janitor() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.evict(time.Now())
+	}
+}
+
+func (s *hostLimiterStore) evict(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for host, l := range s.limiters {
+		// 刚取用的主机即使还没有占用名额也保留，避免同一主机同时存在两份状态
+		if now.Sub(l.lastUsed) > hostLimiterIdle && l.idle(now) {
+			delete(s.limiters, host)
+		}
+	}
+}
+
+// hostLease 一次上游请求占用的名额，请求结束后必须调用 done
+type hostLease struct {
+	limiter *hostLimiter
+	cfg     *Config
+	counted bool
+}
+
+// acquire 为发往 url 所在主机的请求获取名额：超过并发上限或每秒请求数时等待；
+// 主机熔断时 wait 为 true 则等到冷却结束（分片请求），否则立即返回 circuitOpenError（探测等需要尽快响应客户端的请求）
+func (s *hostLimiterStore) acquire(ctx context.Context, cfg *Config, url string, wait bool) (*hostLease, error) {
+	host := ""
+	if u, err := handleUrl.Parse(url); err == nil {
+		host = u.Host
+	}
+	l := s.get(host)
+	counted := cfg.HostMaxInflight > 0
+	for {
+		l.mutex.Lock()
+		now := time.Now()
+		if cfg.HostBreakerThreshold > 0 && now.Before(l.openUntil) {
+			until := l.openUntil
+			l.mutex.Unlock()
+			if !wait {
+				return nil, &circuitOpenError{Host: host, Until: until}
+			}
+			if err := sleepContext(ctx, time.Until(until)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if counted && l.inflight >= cfg.HostMaxInflight {
+			released := l.released
+			l.mutex.Unlock()
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-released:
+			}
+			continue
+		}
+
+		if counted {
+			l.inflight++
+		}
+		var delay time.Duration
+		if cfg.HostRPS > 0 {
+			slot := l.nextSlot
+			if slot.Before(now) {
+				slot = now
+			}
+			l.nextSlot = slot.Add(time.Duration(float64(time.Second) / cfg.HostRPS))
+			delay = slot.Sub(now)
+		}
+		l.mutex.Unlock()
+
+		lease := &hostLease{limiter: l, cfg: cfg, counted: counted}
+		if err := sleepContext(ctx, delay); err != nil {
+			lease.done(0, err)
+			return nil, err
+		}
+		return lease, nil
+	}
+}
+
+// done 归还名额并记录结果：429 / 503 和连接错误计入熔断统计，窗口内达到阈值时熔断；
+// 冷却结束后的第一个失败直接再次熔断并加倍冷却时间，成功后恢复
+func (lease *hostLease) done(statusCode int, err error) {
+	l := lease.limiter
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if lease.counted {
+		l.inflight--
+		close(l.released)
+		l.released = make(chan struct{})
+	}
+
+	threshold := lease.cfg.HostBreakerThreshold
+	if threshold <= 0 || errors.Is(err, context.Canceled) || errors.Is(err, base.ErrDestinationBlocked) {
+		return
+	}
+	now := time.Now()
+	failed := err != nil || statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+	if !failed {
+		if l.trips > 0 && now.After(l.openUntil) {
+			logrus.Infof("上游 %s 已恢复", l.host)
+			l.trips = 0
+		}
+		return
+	}
+
+	kept := l.failures[:0]
+	for _, t := range l.failures {
+		if now.Sub(t) < breakerWindow {
+			kept = append(kept, t)
+		}
+	}
+	l.failures = append(kept, now)
+	if now.Before(l.openUntil) || (l.trips == 0 && len(l.failures) < threshold) {
+		return
+	}
+
+	l.trips++
+	cooldown := time.Duration(lease.cfg.HostBreakerCooldown) * time.Second << (l.trips - 1)
+	if cooldown > breakerMaxCooldown || cooldown <= 0 {
+		cooldown = breakerMaxCooldown
+	}
+	l.openUntil = now.Add(cooldown)
+	l.failures = nil
+	metricCircuitTrips.Inc()
+	logrus.Warnf("上游 %s 频繁返回限流或连接失败，熔断 %v (第 %d 次)", l.host, cooldown, l.trips)
+}
+
+// do 在名额内发出请求，名额一直占用到响应体关闭，用于需要长时间读取响应体的顺序下载
+func (s *hostLimiterStore) do(ctx context.Context, cfg *Config, client *http.Client, req *http.Request, wait bool) (*http.Response, error) {
+	lease, err := s.acquire(ctx, cfg, req.URL.String(), wait)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		lease.done(0, err)
+		return nil, err
+	}
+	resp.Body = &leasedBody{ReadCloser: resp.Body, lease: lease, statusCode: resp.StatusCode}
+	return resp, nil
+}
+
+// leasedBody 关闭时归还名额的响应体
+type leasedBody struct {
+	io.ReadCloser
+	lease      *hostLease
+	statusCode int
+	once       sync.Once
+}
+
+func (b *leasedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.lease.done(b.statusCode, nil) })
+	return err
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// writeCircuitOpen 上游熔断时响应 503 并带上 Retry-After，其他错误返回 false
+func writeCircuitOpen(w http.ResponseWriter, err error) bool {
+	var open *circuitOpenError
+	if !errors.As(err, &open) {
+		return false
+	}
+	seconds := int(time.Until(open.Until).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	return true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"MediaProxy/base"
+)
+
+func TestHostBreaker(t *testing.T) {
+	const url = "https://cdn.example.com/v.mp4"
+	cfg := &Config{HostBreakerThreshold: 3, HostBreakerCooldown: 1}
+	store := &hostLimiterStore{limiters: make(map[string]*hostLimiter)}
+	l := store.get("cdn.example.com")
+
+	steps := []struct {
+		name         string
+		expire       bool // 先让冷却时间结束
+		status       int
+		err          error
+		wantOpen     bool
+		wantTrips    int
+		wantCooldown time.Duration
+	}{
+		{"第一次失败", false, http.StatusServiceUnavailable, nil, false, 0, 0},
+		{"取消的请求不计入", false, 0, context.Canceled, false, 0, 0},
+		{"被安全策略禁止不计入", false, 0, base.ErrDestinationBlocked, false, 0, 0},
+		{"第二次失败", false, http.StatusTooManyRequests, nil, false, 0, 0},
+		{"成功不清空窗口内的失败", false, http.StatusOK, nil, false, 0, 0},
+		{"达到阈值熔断", false, 0, errors.New("connection refused"), true, 1, time.Second},
+		{"冷却结束后再次失败立即熔断并加倍冷却", true, http.StatusServiceUnavailable, nil, true, 2, 2 * time.Second},
+		{"冷却结束后成功恢复", true, http.StatusPartialContent, nil, false, 0, 0},
+		{"恢复后需要重新达到阈值", false, http.StatusServiceUnavailable, nil, false, 0, 0},
+	}
+	for _, tt := range steps {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.expire {
+				l.mutex.Lock()
+				l.openUntil = time.Now().Add(-time.Millisecond)
+				l.mutex.Unlock()
+			}
+			lease, err := store.acquire(context.Background(), cfg, url, false)
+			if err != nil {
+				t.Fatalf("acquire() error = %v", err)
+			}
+			lease.done(tt.status, tt.err)
+
+			l.mutex.Lock()
+			remaining := time.Until(l.openUntil)
+			open, trips := remaining > 0, l.trips
+			l.mutex.Unlock()
+			if open != tt.wantOpen || trips != tt.wantTrips {
+				t.Fatalf("熔断状态 = %v (第 %d 次), want %v (第 %d 次)", open, trips, tt.wantOpen, tt.wantTrips)
+			}
+			if tt.wantOpen && (remaining > tt.wantCooldown || remaining < tt.wantCooldown-500*time.Millisecond) {
+				t.Errorf("冷却时间 = %v, want %v", remaining, tt.wantCooldown)
+			}
+		})
+	}
+
+	t.Run("熔断时立即返回 503", func(t *testing.T) {
+		l.mutex.Lock()
+		l.openUntil = time.Now().Add(time.Minute)
+		l.mutex.Unlock()
+		_, err := store.acquire(context.Background(), cfg, url, false)
+		var open *circuitOpenError
+		if !errors.As(err, &open) {
+			t.Fatalf("acquire() error = %v, want circuitOpenError", err)
+		}
+		w := httptest.NewRecorder()
+		if !writeCircuitOpen(w, err) || w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+			t.Errorf("writeCircuitOpen() status = %d, Retry-After = %q", w.Code, w.Header().Get("Retry-After"))
+		}
+	})
+
+	t.Run("未启用时不熔断", func(t *testing.T) {
+		store := &hostLimiterStore{limiters: make(map[string]*hostLimiter)}
+		for i := 0; i < 10; i++ {
+			lease, err := store.acquire(context.Background(), &Config{}, url, false)
+			if err != nil {
+				t.Fatalf("第 %d 次 acquire() error = %v", i+1, err)
+			}
+			lease.done(http.StatusServiceUnavailable, nil)
+		}
+	})
+}
+
+func TestHostLimiterEvict(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-hostLimiterIdle - time.Minute)
+
+	tests := []struct {
+		name      string
+		limiter   hostLimiter
+		wantEvict bool
+	}{
+		{"空闲超时", hostLimiter{lastUsed: old}, true},
+		{"最近取用过", hostLimiter{lastUsed: now.Add(-time.Minute)}, false},
+		{"有进行中的请求", hostLimiter{lastUsed: old, inflight: 1}, false},
+		{"熔断中", hostLimiter{lastUsed: old, openUntil: now.Add(time.Minute), trips: 1}, false},
+		{"熔断刚结束，连续熔断的计数仍然有效", hostLimiter{lastUsed: old, openUntil: now.Add(-time.Minute), trips: 3}, false},
+		{"熔断结束很久", hostLimiter{lastUsed: old, openUntil: now.Add(-breakerMaxCooldown - time.Minute), trips: 3}, true},
+		{"窗口内有失败", hostLimiter{lastUsed: old, failures: []time.Time{now.Add(-time.Second)}}, false},
+		{"失败已经在窗口之外", hostLimiter{lastUsed: old, failures: []time.Time{now.Add(-breakerWindow - time.Second)}}, true},
+		{"还在限速等待中", hostLimiter{lastUsed: old, nextSlot: now.Add(time.Second)}, false},
+	}
+	store := &hostLimiterStore{limiters: make(map[string]*hostLimiter)}
+	for i := range tests {
+		store.limiters[tests[i].name] = &tests[i].limiter
+	}
+	store.evict(now)
+	for i := range tests {
+		tt := &tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			if _, kept := store.limiters[tt.name]; kept == tt.wantEvict {
+				t.Errorf("evict() 保留 = %v, want %v", kept, !tt.wantEvict)
+			}
+		})
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	handleUrl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"MediaProxy/base"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+// APIKey 一个访问密钥及其限制，限制项为零值时表示不限制
+type APIKey struct {
+	Label          string   `json:"label" yaml:"label"`
+	Key            string   `json:"key" yaml:"key"`
+	MaxSessions    int      `json:"max_sessions,omitempty" yaml:"max_sessions,omitempty"`
+	MaxThreads     int64    `json:"max_threads,omitempty" yaml:"max_threads,omitempty"`
+	Bandwidth      string   `json:"bandwidth,omitempty" yaml:"bandwidth,omitempty"`         // 每秒带宽上限，如 2M
+	MonthlyQuota   string   `json:"monthly_quota,omitempty" yaml:"monthly_quota,omitempty"` // 每月流量，如 100G
+	AllowedDomains []string `json:"allowed_domains,omitempty" yaml:"allowed_domains,omitempty"`
+
+	bandwidth int64
+	quota     int64
+}
+
+// KeyUsage 密钥当月的用量，跨月自动清零
+type KeyUsage struct {
+	Month    string `json:"month"`
+	Bytes    int64  `json:"bytes"`
+	Requests int64  `json:"requests"`
+}
+
+// KeyInfo 管理接口输出的密钥信息，密钥本身只显示前后几位
+type KeyInfo struct {
+	APIKey
+	ActiveSessions int64    `json:"active_sessions"`
+	Usage          KeyUsage `json:"usage"`
+}
+
+// keyRuntime 密钥的运行状态，按 label 保存，重新加载密钥文件时保留
+type keyRuntime struct {
+	active    atomic.Int64
+	bandwidth int64
+	limiter   atomic.Pointer[rate.Limiter] // nil 表示不限速
+}
+
+// KeyStore 密钥存储：从 keys-file 加载，管理接口修改后写回文件，用量定期保存到 usage-file
+type KeyStore struct {
+	mutex     sync.RWMutex
+	file      string
+	usageFile string
+	keys      map[string]*APIKey // 密钥 -> APIKey
+	labels    map[string]*APIKey // label -> APIKey
+	runtime   map[string]*keyRuntime
+	usage     map[string]*KeyUsage
+	dirty     bool
+	saverOnce sync.Once
+}
+
+var keyStore = &KeyStore{
+	keys:    make(map[string]*APIKey),
+	labels:  make(map[string]*APIKey),
+	runtime: make(map[string]*keyRuntime),
+	usage:   make(map[string]*KeyUsage),
+}
+
+var errQuotaExceeded = errors.New("本月流量已用完")
+
+func currentMonth() string {
+	return time.Now().Format("2006-01")
+}
+
+// normalize 校验并解析限制项
+func (k *APIKey) normalize() error {
+	k.Label = strings.TrimSpace(k.Label)
+	k.Key = strings.TrimSpace(k.Key)
+	if k.Label == "" || k.Key == "" {
+		return fmt.Errorf("密钥的 label 和 key 不能为空")
+	}
+	if k.MaxSessions < 0 || k.MaxThreads < 0 {
+		return fmt.Errorf("密钥 %s 的会话数和线程数不能小于 0", k.Label)
+	}
+	k.bandwidth, k.quota = 0, 0
+	var err error
+	if k.Bandwidth != "" {
+		if k.bandwidth, err = parseSize(k.Bandwidth); err != nil {
+			return fmt.Errorf("密钥 %s 的 bandwidth 无效: %v", k.Label, err)
+		}
+	}
+	if k.MonthlyQuota != "" {
+		if k.quota, err = parseSize(k.MonthlyQuota); err != nil {
+			return fmt.Errorf("密钥 %s 的 monthly_quota 无效: %v", k.Label, err)
+		}
+	}
+	return nil
+}
+
+// masked 隐藏密钥中间部分
+func (k APIKey) masked() APIKey {
+	if len(k.Key) > 8 {
+		k.Key = k.Key[:4] + "***" + k.Key[len(k.Key)-4:]
+	} else {
+		k.Key = "***"
+	}
+	return k
+}
+
+// Prepare 读取并校验密钥文件，返回替换全部密钥的 apply；usageFile 为空时使用密钥文件同目录下的 <name>.usage.json
+func (s *KeyStore) Prepare(file string, usageFile string) (apply func(), err error) {
+	if file != "" && usageFile == "" {
+		usageFile = strings.TrimSuffix(file, filepath.Ext(file)) + ".usage.json"
+	}
+
+	var keys []*APIKey
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("读取密钥文件失败: %v", err)
+		}
+		if len(data) > 0 {
+			if strings.EqualFold(filepath.Ext(file), ".json") {
+				err = json.Unmarshal(data, &keys)
+			} else {
+				err = yaml.Unmarshal(data, &keys)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("解析密钥文件 %s 失败: %v", file, err)
+			}
+		}
+	}
+	byKey, byLabel, err := indexKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.useKeys(keys, byKey, byLabel)
+		if usageFile != s.usageFile {
+			s.usageFile = usageFile
+			s.loadUsage()
+		}
+		s.file = file
+		if file != "" {
+			s.saverOnce.Do(func() { go s.saveUsageLoop() })
+		}
+	}, nil
+}
+
+// indexKeys 校验密钥并按 key 和 label 建立索引
+func indexKeys(keys []*APIKey) (byKey map[string]*APIKey, byLabel map[string]*APIKey, err error) {
+	byKey = make(map[string]*APIKey, len(keys))
+	byLabel = make(map[string]*APIKey, len(keys))
+	for _, k := range keys {
+		if err := k.normalize(); err != nil {
+			return nil, nil, err
+		}
+		if byLabel[k.Label] != nil {
+			return nil, nil, fmt.Errorf("密钥 label 重复: %s", k.Label)
+		}
+		if byKey[k.Key] != nil {
+			return nil, nil, fmt.Errorf("密钥 %s 与 %s 的 key 重复", k.Label, byKey[k.Key].Label)
+		}
+		byKey[k.Key] = k
+		byLabel[k.Label] = k
+	}
+	return byKey, byLabel, nil
+}
+
+// setKeys 替换全部密钥，save 为 true 时先写回密钥文件，写入失败时保持原来的密钥不变，调用方持有锁
+func (s *KeyStore) setKeys(keys []*APIKey, save bool) error {
+	byKey, byLabel, err := indexKeys(keys)
+	if err != nil {
+		return err
+	}
+	if save {
+		if err := s.saveKeys(keys); err != nil {
+			return fmt.Errorf("写回密钥文件失败: %v", err)
+		}
+	}
+	s.useKeys(keys, byKey, byLabel)
+	return nil
+}
+
+// useKeys 替换全部密钥并同步各密钥的限速器，调用方持有锁
+func (s *KeyStore) useKeys(keys []*APIKey, byKey map[string]*APIKey, byLabel map[string]*APIKey) {
+	s.keys = byKey
+	s.labels = byLabel
+
+	for _, k := range keys {
+		rt := s.runtime[k.Label]
+		if rt == nil {
+			rt = &keyRuntime{bandwidth: -1}
+			s.runtime[k.Label] = rt
+		}
+		if rt.bandwidth != k.bandwidth {
+			rt.bandwidth = k.bandwidth
+			if k.bandwidth > 0 {
+				// 突发量至少 64K，保证单次写入不会超过令牌桶容量太多
+				burst := int(k.bandwidth)
+				if burst < 64*1024 {
+					burst = 64 * 1024
+				}
+				rt.limiter.Store(rate.NewLimiter(rate.Limit(k.bandwidth), burst))
+			} else {
+				rt.limiter.Store(nil)
+			}
+		}
+	}
+}
+
+func (s *KeyStore) loadUsage() {
+	s.usage = make(map[string]*KeyUsage)
+	if s.usageFile == "" {
+		return
+	}
+	data, err := os.ReadFile(s.usageFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logrus.Warnf("读取用量文件失败: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &s.usage); err != nil {
+		logrus.Warnf("解析用量文件 %s 失败: %v", s.usageFile, err)
+	}
+}
+
+// Enabled 是否配置了密钥
+func (s *KeyStore) Enabled() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.keys) > 0
+}
+
+// Lookup 按密钥查找
+func (s *KeyStore) Lookup(key string) *APIKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.keys[key]
+}
+
+// ByLabel 按 label 查找
+func (s *KeyStore) ByLabel(label string) *APIKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.labels[label]
+}
+
+// usageOf 返回当月用量，跨月时清零，调用方持有写锁
+func (s *KeyStore) usageOf(label string) *KeyUsage {
+	month := currentMonth()
+	u := s.usage[label]
+	if u == nil {
+		u = &KeyUsage{Month: month}
+		s.usage[label] = u
+	} else if u.Month != month {
+		*u = KeyUsage{Month: month}
+		s.dirty = true
+	}
+	return u
+}
+
+// addBytes 累计流量，返回当月已用流量
+func (s *KeyStore) addBytes(label string, n int) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u := s.usageOf(label)
+	u.Bytes += int64(n)
+	s.dirty = true
+	return u.Bytes
+}
+
+// List 返回所有密钥及其用量，按 label 排序
+func (s *KeyStore) List() []KeyInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	infos := make([]KeyInfo, 0, len(s.labels))
+	for label, k := range s.labels {
+		infos = append(infos, KeyInfo{
+			APIKey:         k.masked(),
+			ActiveSessions: s.runtime[label].active.Load(),
+			Usage:          *s.usageOf(label),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Label < infos[j].Label
+	})
+	return infos
+}
+
+// Put 新增或更新密钥并写回密钥文件；更新时 key 为空表示保留原密钥，新增时 key 为空则自动生成
+func (s *KeyStore) Put(k APIKey) (*APIKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == "" {
+		return nil, fmt.Errorf("未设置 keys-file，无法保存密钥")
+	}
+	if k.Key == "" {
+		if old := s.labels[k.Label]; old != nil {
+			k.Key = old.Key
+		} else {
+			b := make([]byte, 16)
+			rand.Read(b)
+			k.Key = hex.EncodeToString(b)
+		}
+	}
+	keys := make([]*APIKey, 0, len(s.labels)+1)
+	for label, old := range s.labels {
+		if label != k.Label {
+			copied := *old
+			keys = append(keys, &copied)
+		}
+	}
+	keys = append(keys, &k)
+	if err := s.setKeys(keys, true); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// Delete 删除密钥并写回密钥文件
+func (s *KeyStore) Delete(label string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.labels[label] == nil {
+		return false, nil
+	}
+	if s.file == "" {
+		return false, fmt.Errorf("未设置 keys-file，无法保存密钥")
+	}
+	keys := make([]*APIKey, 0, len(s.labels))
+	for l, old := range s.labels {
+		if l != label {
+			copied := *old
+			keys = append(keys, &copied)
+		}
+	}
+	if err := s.setKeys(keys, true); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// saveKeys 按 label 排序后写回密钥文件，调用方持有锁
+func (s *KeyStore) saveKeys(keys []*APIKey) error {
+	keys = append([]*APIKey(nil), keys...)
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Label < keys[j].Label
+	})
+	var data []byte
+	var err error
+	if strings.EqualFold(filepath.Ext(s.file), ".json") {
+		data, err = json.MarshalIndent(keys, "", "  ")
+	} else {
+		data, err = yaml.Marshal(keys)
+	}
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.file, data, 0600)
+}
+
+// SaveUsage 保存用量文件
+func (s *KeyStore) SaveUsage() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.dirty || s.usageFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s.usage, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.usageFile, data, 0600)
+	}
+	if err != nil {
+		logrus.Warnf("保存用量文件失败: %v", err)
+		return
+	}
+	s.dirty = false
+}
+
+func (s *KeyStore) saveUsageLoop() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.SaveUsage()
+	}
+}
+
+// writeFileAtomic 先写临时文件再重命名，避免写入中途退出导致文件损坏
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// admitKey 检查密钥的域名和流量限制；通过后返回统计流量并限速的 ResponseWriter，
+// key 为 nil（主密钥或未开启认证）时不做限制。会话数在开始传输响应体时由 startKeySession 检查
+func admitKey(w http.ResponseWriter, req *http.Request, key *APIKey, targetUrl string) (http.ResponseWriter, error) {
+	if key == nil {
+		return w, nil
+	}
+	if len(key.AllowedDomains) > 0 {
+		u, err := handleUrl.Parse(targetUrl)
+		if err != nil || !base.MatchDomain(u.Hostname(), key.AllowedDomains) {
+			return nil, &accessError{http.StatusForbidden, "该密钥不允许访问此域名"}
+		}
+	}
+
+	keyStore.mutex.Lock()
+	rt := keyStore.runtime[key.Label]
+	usage := keyStore.usageOf(key.Label)
+	if key.quota > 0 && usage.Bytes >= key.quota {
+		keyStore.mutex.Unlock()
+		return nil, &accessError{http.StatusTooManyRequests, errQuotaExceeded.Error()}
+	}
+	usage.Requests++
+	keyStore.dirty = true
+	keyStore.mutex.Unlock()
+
+	mw := &meteredWriter{ResponseWriter: w, ctx: req.Context(), label: key.Label, quota: key.quota, rt: rt}
+	return mw, nil
+}
+
+// acquireKeySession 占用密钥的一个并发会话，返回结束时调用的 release
+func acquireKeySession(key *APIKey) (func(), error) {
+	if key == nil {
+		return func() {}, nil
+	}
+	keyStore.mutex.Lock()
+	defer keyStore.mutex.Unlock()
+	rt := keyStore.runtime[key.Label]
+	if key.MaxSessions > 0 && rt.active.Load() >= int64(key.MaxSessions) {
+		return nil, &accessError{http.StatusTooManyRequests, fmt.Sprintf("该密钥的并发会话数已达上限 (%d)", key.MaxSessions)}
+	}
+	rt.active.Add(1)
+	return func() { rt.active.Add(-1) }, nil
+}
+
+// startKeySession 为传输响应体的 GET 请求占用密钥的一个会话，多线程下载、落盘、顺序转发和直接转发都计入 max_sessions；
+// 达到上限时输出 429 并返回 false。HEAD 请求没有响应体，不占用会话
+func startKeySession(w http.ResponseWriter, req *http.Request, key *APIKey) (func(), bool) {
+	if req.Method != http.MethodGet {
+		return func() {}, true
+	}
+	release, err := acquireKeySession(key)
+	if err != nil {
+		requestLogger(req.Context()).Warnf("拒绝来自 %s 的请求: %v", clientAddr(req), err)
+		writeAccessError(w, err)
+		return nil, false
+	}
+	return release, true
+}
+
+// keyContext 把密钥的 allowed_domains 附加到 ctx，之后的重定向、刷新后的直链、镜像等上游请求都受同样的限制
+func keyContext(ctx context.Context, key *APIKey) context.Context {
+	if key == nil {
+		return ctx
+	}
+	return base.WithAllowedDomains(ctx, key.AllowedDomains)
+}
+
+// meteredWriter 统计写给客户端的流量，按密钥的带宽上限限速，超出当月流量时中断传输
+type meteredWriter struct {
+	http.ResponseWriter
+	ctx   context.Context
+	label string
+	quota int64
+	rt    *keyRuntime
+}
+
+func (m *meteredWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if limiter := m.rt.limiter.Load(); limiter != nil {
+			if n > limiter.Burst() {
+				n = limiter.Burst()
+			}
+			if err := limiter.WaitN(m.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		k, err := m.ResponseWriter.Write(b[:n])
+		written += k
+		used := keyStore.addBytes(m.label, k)
+		if err != nil {
+			return written, err
+		}
+		if m.quota > 0 && used >= m.quota {
+			return written, errQuotaExceeded
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (m *meteredWriter) Flush() {
+	if f, ok := m.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (m *meteredWriter) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+// handleListKeys GET /api/keys
+func handleListKeys(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": keyStore.List(),
+	})
+}
+
+// handlePutKey PUT /api/keys/{label}，请求体为 APIKey 的 JSON，返回完整的密钥
+func handlePutKey(w http.ResponseWriter, req *http.Request) {
+	var k APIKey
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&k); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("请求体格式错误: %v", err)})
+		return
+	}
+	k.Label = req.PathValue("label")
+	saved, err := keyStore.Put(k)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	logrus.Infof("密钥 %s 已被管理接口保存 (来自 %s)", saved.Label, req.RemoteAddr)
+	writeJSON(w, http.StatusOK, saved)
+}
+
+// handleDeleteKey DELETE /api/keys/{label}
+func handleDeleteKey(w http.ResponseWriter, req *http.Request) {
+	label := req.PathValue("label")
+	ok, err := keyStore.Delete(label)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "密钥不存在"})
+		return
+	}
+	logrus.Infof("密钥 %s 已被管理接口删除 (来自 %s)", label, req.RemoteAddr)
+	writeJSON(w, http.StatusOK, map[string]string{"label": label, "status": "deleted"})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useTestKeys 替换 keyStore 中的密钥，测试结束后清空
+func useTestKeys(t *testing.T, keys ...*APIKey) {
+	t.Helper()
+	keyStore.mutex.Lock()
+	defer keyStore.mutex.Unlock()
+	if err := keyStore.setKeys(keys, false); err != nil {
+		t.Fatalf("setKeys() error = %v", err)
+	}
+	t.Cleanup(func() {
+		keyStore.mutex.Lock()
+		defer keyStore.mutex.Unlock()
+		keyStore.setKeys(nil, false)
+	})
+}
+
+func TestStartKeySession(t *testing.T) {
+	key := &APIKey{Label: "alice", Key: "alice-secret-key", MaxSessions: 2}
+	useTestKeys(t, key)
+
+	var releases []func()
+	steps := []struct {
+		name       string
+		method     string
+		release    bool // 先结束最早的一个会话
+		wantOK     bool
+		wantStatus int
+	}{
+		{"第一个会话", http.MethodGet, false, true, http.StatusOK},
+		{"第二个会话", http.MethodGet, false, true, http.StatusOK},
+		{"超出会话数", http.MethodGet, false, false, http.StatusTooManyRequests},
+		{"HEAD 不占用会话", http.MethodHead, false, true, http.StatusOK},
+		{"结束一个会话后可以开始新会话", http.MethodGet, true, true, http.StatusOK},
+		{"再次超出会话数", http.MethodGet, false, false, http.StatusTooManyRequests},
+	}
+	for _, tt := range steps {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.release {
+				releases[0]()
+				releases = releases[1:]
+			}
+			w := httptest.NewRecorder()
+			release, ok := startKeySession(w, httptest.NewRequest(tt.method, "/", nil), key)
+			if ok != tt.wantOK || w.Code != tt.wantStatus {
+				t.Fatalf("startKeySession() = %v (status %d), want %v (status %d)", ok, w.Code, tt.wantOK, tt.wantStatus)
+			}
+			if ok && tt.method == http.MethodGet {
+				releases = append(releases, release)
+			}
+		})
+	}
+
+	t.Run("没有密钥时不限制", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			if _, ok := startKeySession(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), nil); !ok {
+				t.Fatalf("startKeySession(nil) 第 %d 次被拒绝", i+1)
+			}
+		}
+	})
+}
+
+func TestAdmitKeyAllowedDomains(t *testing.T) {
+	limited := &APIKey{Label: "alice", Key: "alice-secret-key", AllowedDomains: []string{"*.example.com", "cdn.example.net"}}
+	open := &APIKey{Label: "bob", Key: "bob-secret-key"}
+	useTestKeys(t, limited, open)
+
+	tests := []struct {
+		name       string
+		key        *APIKey
+		url        string
+		wantStatus int
+	}{
+		{"通配符匹配子域名", limited, "https://pan.example.com/f.mp4", http.StatusOK},
+		{"通配符匹配多级子域名", limited, "https://a.cdn.example.com/f.mp4", http.StatusOK},
+		{"精确匹配", limited, "https://cdn.example.net/f.mp4", http.StatusOK},
+		{"大小写不敏感", limited, "https://CDN.Example.NET/f.mp4", http.StatusOK},
+		{"通配符不匹配根域名", limited, "https://example.com/f.mp4", http.StatusForbidden},
+		{"精确规则不匹配子域名", limited, "https://a.cdn.example.net/f.mp4", http.StatusForbidden},
+		{"后缀相同的其他域名", limited, "https://evilexample.com/f.mp4", http.StatusForbidden},
+		{"内网地址", limited, "http://127.0.0.1:9000/f.mp4", http.StatusForbidden},
+		{"无法解析的地址", limited, "http://[::1/f.mp4", http.StatusForbidden},
+		{"未限制域名的密钥", open, "http://127.0.0.1:9000/f.mp4", http.StatusOK},
+		{"没有密钥", nil, "http://127.0.0.1:9000/f.mp4", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			_, err := admitKey(w, httptest.NewRequest(http.MethodGet, "/", nil), tt.key, tt.url)
+			status := http.StatusOK
+			if err != nil {
+				writeAccessError(w, err)
+				status = w.Code
+			}
+			if status != tt.wantStatus {
+				t.Errorf("admitKey(%q) status = %d, want %d (err: %v)", tt.url, status, tt.wantStatus, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	handleUrl "net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// RequestIDHeader 请求 ID 的响应头，客户端传入合法的同名请求头时沿用该 ID
+const RequestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestInfoKey struct{}
+
+// requestInfo 贯穿一次请求的上下文信息，处理函数可以补充上游主机等字段供访问日志使用
+type requestInfo struct {
+	ID           string
+	ClientIP     string // 真实客户端地址，经过可信反向代理时取自 X-Forwarded-For
+	UpstreamHost string
+	KeyLabel     string
+	Log          *logrus.Entry
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func getRequestInfo(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return nil
+}
+
+// requestLogger 返回带 request_id 字段的日志记录器
+func requestLogger(ctx context.Context) *logrus.Entry {
+	if info := getRequestInfo(ctx); info != nil {
+		return info.Log
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// setUpstreamHost 记录本次请求的上游主机，写入访问日志
+func setUpstreamHost(ctx context.Context, rawUrl string) {
+	info := getRequestInfo(ctx)
+	if info == nil {
+		return
+	}
+	if u, err := handleUrl.Parse(rawUrl); err == nil {
+		info.UpstreamHost = u.Host
+	}
+}
+
+// setRequestKey 记录本次请求使用的密钥，写入访问日志和会话信息
+func setRequestKey(ctx context.Context, label string) {
+	if info := getRequestInfo(ctx); info != nil {
+		info.KeyLabel = label
+		info.Log = info.Log.WithField("key", label)
+	}
+}
+
+// redactPath 隐藏路径中 /k/{key}/ 形式的密钥；认证失败或未开启 path 来源时请求路径不会被改写，密钥仍在路径中
+func redactPath(path string) string {
+	rest, ok := strings.CutPrefix(path, "/k/")
+	if !ok {
+		return path
+	}
+	_, remain, _ := strings.Cut(rest, "/")
+	return "/k/***/" + remain
+}
+
+// withRequestLog 为每个请求分配 ID 并写入响应头，请求结束后统计指标并输出一行访问日志
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		info := &requestInfo{
+			ID:  id,
+			Log: logrus.WithField("request_id", id),
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		req = req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info))
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+
+		metricRequests.WithLabelValues(metricMethod(req.Method), strconv.Itoa(rec.status)).Inc()
+		if getConfig().AccessLog {
+			info.Log.WithFields(logrus.Fields{
+				"type":     "access",
+				"client":   clientAddr(req),
+				"method":   req.Method,
+				"path":     redactPath(req.URL.Path),
+				"proto":    req.Proto,
+				"range":    req.Header.Get("Range"),
+				"status":   rec.status,
+				"bytes":    rec.bytes,
+				"duration": time.Since(start).Milliseconds(),
+				"upstream": info.UpstreamHost,
+			}).Info("access")
+		}
+	})
+}
+
+// logSettings 日志输出相关的配置，变化时才重新打开日志文件
+type logSettings struct {
+	Format     string
+	File       string
+	MaxSize    int64
+	MaxBackups int
+}
+
+var (
+	currentLogSettings logSettings
+	currentLogFile     io.Closer
+)
+
+// prepareLogSettings 校验日志配置，返回设置日志格式和输出位置的 apply；
+// log-file 不为空时写入按大小轮转的日志文件
+func prepareLogSettings(s logSettings) (apply func(), err error) {
+	var formatter logrus.Formatter
+	switch s.Format {
+	case "text", "":
+		formatter = &logrus.TextFormatter{FullTimestamp: true}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return nil, fmt.Errorf("无效的 log-format 参数: %s (可选 text / json)", s.Format)
+	}
+
+	return func() {
+		logrus.SetFormatter(formatter)
+		if s == currentLogSettings && currentLogFile != nil {
+			return
+		}
+		old := currentLogFile
+		if s.File == "" {
+			logrus.SetOutput(os.Stdout)
+			currentLogFile = nil
+		} else {
+			maxSizeMB := int(s.MaxSize / (1024 * 1024))
+			if maxSizeMB < 1 {
+				maxSizeMB = 1
+			}
+			file := &lumberjack.Logger{
+				Filename:   s.File,
+				MaxSize:    maxSizeMB,
+				MaxBackups: s.MaxBackups,
+			}
+			logrus.SetOutput(file)
+			currentLogFile = file
+		}
+		currentLogSettings = s
+		if old != nil {
+			old.Close()
+		}
+	}, nil
+}
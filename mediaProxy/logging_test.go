@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestRedactPath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"根路径", "/", "/"},
+		{"管理接口", "/api/sessions", "/api/sessions"},
+		{"路径中的密钥", "/k/alice-secret-key/", "/k/***/"},
+		{"密钥后还有路径", "/k/alice-secret-key/video.mp4", "/k/***/video.mp4"},
+		{"没有结尾的斜杠", "/k/alice-secret-key", "/k/***/"},
+		{"空密钥", "/k/", "/k/***/"},
+		{"不是 /k/ 前缀", "/kk/secret/", "/kk/secret/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactPath(tt.path); got != tt.want {
+				t.Errorf("redactPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mediaproxy_requests_total",
+		Help: "客户端请求数，按方法和状态码区分",
+	}, []string{"method", "status"})
+
+	metricChunkRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mediaproxy_upstream_chunk_requests_total",
+		Help: "上游分片请求数，按状态码区分，连接失败记为 error",
+	}, []string{"status"})
+
+	metricRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mediaproxy_upstream_retries_total",
+		Help: "分片请求重试次数，按原因区分",
+	}, []string{"reason"})
+
+	metricShortReads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mediaproxy_upstream_short_reads_total",
+		Help: "上游返回数据长度不足的次数",
+	})
+
+	metricRangeMismatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mediaproxy_upstream_content_range_mismatches_total",
+		Help: "上游返回的 Content-Range 与请求不一致的次数",
+	})
+
+	metricValidatorMismatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mediaproxy_upstream_validator_mismatches_total",
+		Help: "分片响应的 ETag / Last-Modified / 文件大小与探测结果不一致的次数",
+	})
+
+	metricCircuitTrips = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mediaproxy_upstream_circuit_trips_total",
+		Help: "上游主机因频繁限流或连接失败被熔断的次数",
+	})
+
+	metricBytesIn = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mediaproxy_upstream_bytes_total",
+		Help: "从上游接收的分片数据字节数",
+	})
+
+	metricBytesOut = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mediaproxy_client_bytes_total",
+		Help: "发送给客户端的媒体数据字节数",
+	})
+
+	metricChunkLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mediaproxy_upstream_chunk_duration_seconds",
+		Help:    "单次分片请求的耗时",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 4, 8, 16, 30},
+	})
+
+	metricCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mediaproxy_cache_requests_total",
+		Help: "mediaCache 头信息缓存的查询次数，按 hit / miss 区分",
+	}, []string{"result"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metricRequests,
+		metricChunkRequests,
+		metricRetries,
+		metricShortReads,
+		metricRangeMismatches,
+		metricValidatorMismatches,
+		metricCircuitTrips,
+		metricBytesIn,
+		metricBytesOut,
+		metricChunkLatency,
+		metricCache,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mediaproxy_active_sessions",
+			Help: "当前活跃的多线程下载会话数",
+		}, func() float64 {
+			return float64(sessions.Count())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mediaproxy_buffered_bytes",
+			Help: "所有会话中已下载但尚未发送给客户端的数据量",
+		}, func() float64 {
+			return float64(sessions.BufferedBytes())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mediaproxy_cache_hit_ratio",
+			Help: "mediaCache 头信息缓存命中率",
+		}, cacheHitRatio),
+	)
+	for _, result := range []string{"hit", "miss"} {
+		metricCache.WithLabelValues(result)
+	}
+}
+
+// metricMethod 返回请求数指标的 method 标签，其他方法统一记为 OTHER，避免任意方法名造成标签数量无限增长
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions, http.MethodPatch:
+		return method
+	}
+	return "OTHER"
+}
+
+func cacheHitRatio() float64 {
+	hits := counterValue(metricCache.WithLabelValues("hit"))
+	misses := counterValue(metricCache.WithLabelValues("miss"))
+	if hits+misses == 0 {
+		return 0
+	}
+	return hits / (hits + misses)
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
+
+// observeChunkRequest 记录一次分片请求的结果，err 不为空时状态记为 error
+func observeChunkRequest(start time.Time, statusCode int, err error) {
+	metricChunkLatency.Observe(time.Since(start).Seconds())
+	if err != nil {
+		metricChunkRequests.WithLabelValues("error").Inc()
+		return
+	}
+	metricChunkRequests.WithLabelValues(strconv.Itoa(statusCode)).Inc()
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// statusRecorder 记录响应状态码和写出的字节数，同时保留 Flusher / Hijacker 能力
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status = code
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := r.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("hijack not supported")
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	handleUrl "net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mirrorMaxFailures   = 3                // 连续失败多少次后暂停使用该镜像
+	mirrorDisableTime   = 30 * time.Second // 暂停使用的时长，之后重新参与分配
+	mirrorVerifyTimeout = 10 * time.Second // 校验镜像大小的超时
+)
+
+// mirror 同一资源的一个下载地址。URL 为空表示主地址（探测时解析出的终点或刷新后的直链，由 ProxyDownloadStruct 管理）
+type mirror struct {
+	URL           string
+	speed         float64 // 最近的下载速度（字节/秒），0 表示还没有测量
+	failures      int
+	disabledUntil time.Time
+}
+
+func (m *mirror) primary() bool {
+	return m.URL == ""
+}
+
+// mirrorSet 一个会话可用的全部下载地址，分片按测得的速度加权分配到各个地址，
+// 连续失败的地址暂停使用，它的分片在重试时自动分配给其他地址
+type mirrorSet struct {
+	mutex   sync.Mutex
+	mirrors []*mirror
+}
+
+func newMirrorSet(urls []string) *mirrorSet {
+	s := &mirrorSet{mirrors: []*mirror{{}}}
+	for _, url := range urls {
+		s.mirrors = append(s.mirrors, &mirror{URL: url})
+	}
+	return s
+}
+
+func (s *mirrorSet) len() int {
+	return len(s.mirrors)
+}
+
+// pick 按速度加权随机选择一个地址，跳过暂停中的地址和 exclude（上次失败的地址）；
+// 还没有测量过速度的地址按当前最快的速度计算，保证每个地址都能被尝试
+func (s *mirrorSet) pick(exclude *mirror) *mirror {
+	if len(s.mirrors) == 1 {
+		return s.mirrors[0]
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	var candidates []*mirror
+	for _, m := range s.mirrors {
+		if m != exclude && now.After(m.disabledUntil) {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		// 全部暂停时仍然要下载，退回到主地址
+		return s.mirrors[0]
+	}
+
+	fastest := 0.0
+	for _, m := range candidates {
+		if m.speed > fastest {
+			fastest = m.speed
+		}
+	}
+	if fastest == 0 {
+		fastest = 1
+	}
+	total := 0.0
+	for _, m := range candidates {
+		total += mirrorWeight(m, fastest)
+	}
+	r := rand.Float64() * total
+	for _, m := range candidates {
+		if r -= mirrorWeight(m, fastest); r < 0 {
+			return m
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+func mirrorWeight(m *mirror, fastest float64) float64 {
+	if m.speed == 0 {
+		return fastest
+	}
+	return m.speed
+}
+
+// succeed 记录一次成功的分片请求，速度按指数加权平均平滑
+func (s *mirrorSet) succeed(m *mirror, n int, elapsed time.Duration) {
+	if len(s.mirrors) == 1 || elapsed <= 0 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	speed := float64(n) / elapsed.Seconds()
+	if m.speed == 0 {
+		m.speed = speed
+	} else {
+		m.speed = m.speed*0.7 + speed*0.3
+	}
+	m.failures = 0
+}
+
+// fail 记录一次失败，连续失败过多时暂停使用；返回是否还有其他可用的地址可以接手这个分片
+func (s *mirrorSet) fail(m *mirror, log func(format string, args ...interface{})) bool {
+	if len(s.mirrors) == 1 {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if m.failures++; m.failures >= mirrorMaxFailures {
+		s.disableLocked(m, log)
+	}
+	return s.othersAvailableLocked(m)
+}
+
+// disable 立即暂停使用 m（例如镜像返回的文件与主地址不一致）
+func (s *mirrorSet) disable(m *mirror, log func(format string, args ...interface{})) {
+	if len(s.mirrors) == 1 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.disableLocked(m, log)
+}
+
+func (s *mirrorSet) disableLocked(m *mirror, log func(format string, args ...interface{})) {
+	m.failures = 0
+	if time.Now().Before(m.disabledUntil) {
+		return
+	}
+	m.disabledUntil = time.Now().Add(mirrorDisableTime)
+	name := "主地址"
+	if !m.primary() {
+		name = redactURL(m.URL)
+	}
+	log("%s 暂停使用 %v，分片改由其他地址下载", name, mirrorDisableTime)
+}
+
+func (s *mirrorSet) othersAvailableLocked(m *mirror) bool {
+	now := time.Now()
+	for _, other := range s.mirrors {
+		if other != m && now.After(other.disabledUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifiedMirrors 按文件大小 Size 校验通过的镜像
+type verifiedMirrors struct {
+	Size int64
+	URLs []string
+}
+
+// mirrorsKey 镜像来自请求参数，校验结果只给同一作用域、同一密钥、带着相同 mirror 参数的请求使用，
+// 一个客户端提供的镜像不会被用于其他客户端的会话
+func mirrorsKey(ctx context.Context, scope string, urls []string) string {
+	var keyLabel string
+	if info := getRequestInfo(ctx); info != nil {
+		keyLabel = info.KeyLabel
+	}
+	return scope + "#Mirrors#" + keyLabel + "#" + strings.Join(urls, "\n")
+}
+
+// cachedMirrors 返回本次请求的 mirror 参数中校验通过的镜像，需要先调用 prepareMirrors
+func cachedMirrors(ctx context.Context, scope string, req *http.Request) []string {
+	urls := mirrorParams(req)
+	if len(urls) == 0 {
+		return nil
+	}
+	if v, found := mediaCache.Get(mirrorsKey(ctx, scope, urls)); found {
+		return v.(verifiedMirrors).URLs
+	}
+	return nil
+}
+
+// prepareMirrors 校验本次请求的 mirror 参数，结果按 mirrorsKey 缓存；文件大小变化后重新校验
+func prepareMirrors(ctx context.Context, cfg *Config, scope string, req *http.Request, primary string, header map[string][]string, jar *cookiejar.Jar, size int64) {
+	urls := mirrorParams(req)
+	if len(urls) == 0 {
+		return
+	}
+	key := mirrorsKey(ctx, scope, urls)
+	if v, found := mediaCache.Get(key); found && v.(verifiedMirrors).Size == size {
+		return
+	}
+	verified := verifyMirrors(ctx, cfg, primary, urls, header, jar, size)
+	requestLogger(ctx).Debugf("%d 个镜像中 %d 个与主地址的文件大小一致", len(urls), len(verified))
+	mediaCache.Set(key, verifiedMirrors{Size: size, URLs: verified}, 1800*time.Second)
+}
+
+// mirrorParams 取出请求中的 mirror 参数（可以重复），form=base64 时与 url 参数一样按 Base64 解码
+func mirrorParams(req *http.Request) []string {
+	query := req.URL.Query()
+	var urls []string
+	for _, url := range query["mirror"] {
+		if query.Get("form") == "base64" {
+			decoded, err := base64.StdEncoding.DecodeString(url)
+			if err != nil {
+				continue
+			}
+			url = string(decoded)
+		}
+		if url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// verifyMirrors 并发探测各镜像，只保留目标地址策略和密钥 allowed_domains 允许、支持 Range 且文件大小与主地址一致的镜像。
+// 固定使用小范围 GET 探测，不受 probe-strategies 和主机记住的探测方式影响（head / full 的响应没有 Content-Range）；
+// 与主地址 primary 不在同一主机的镜像不带客户端的凭据头
+func verifyMirrors(ctx context.Context, cfg *Config, primary string, urls []string, header map[string][]string, jar *cookiejar.Jar, size int64) []string {
+	log := requestLogger(ctx)
+	ctx, cancel := context.WithTimeout(ctx, mirrorVerifyTimeout)
+	defer cancel()
+
+	ok := make([]bool, len(urls))
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			u, err := handleUrl.Parse(url)
+			if err == nil {
+				err = cfg.clients.CheckContextHost(ctx, u.Hostname())
+			}
+			if err != nil {
+				log.Warnf("镜像 %v 不可用: %v", redactURL(url), redactError(err))
+				return
+			}
+			resp, err := probeOnce(ctx, cfg, probeStrategies["range"], url, headerForHost(header, primary, url), jar)
+			if err != nil {
+				log.Warnf("镜像 %v 不可用: %v", redactURL(url), redactError(err))
+				return
+			}
+			resp.RawBody().Close()
+			_, _, total, err := parseContentRange(resp.Header().Get("Content-Range"))
+			if err != nil || resp.StatusCode() != http.StatusPartialContent {
+				log.Warnf("镜像 %v 不支持 Range (statusCode: %d)，不使用", redactURL(url), resp.StatusCode())
+				return
+			}
+			if total != size {
+				log.Warnf("镜像 %v 的文件大小 %d 与主地址 %d 不一致，不使用", redactURL(url), total, size)
+				return
+			}
+			ok[i] = true
+		}(i, url)
+	}
+	wg.Wait()
+
+	var verified []string
+	for i, url := range urls {
+		if ok[i] {
+			verified = append(verified, url)
+		}
+	}
+	return verified
+}
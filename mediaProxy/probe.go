@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	handleUrl "net/url"
+	"os"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ProbeStrategyHeader 响应头，标明获取头信息时使用的探测方式，便于排查
+const ProbeStrategyHeader = "X-Probe-Strategy"
+
+// probeStrategy 获取上游头信息的一种方式。部分源站对 bytes=0-1023 的探测请求表现异常：
+// 忽略 Range 返回完整内容、拒绝首个带 Range 的请求，或者只有 HEAD 的响应是正确的
+type probeStrategy struct {
+	Name   string
+	Method string
+	Range  string
+}
+
+var probeStrategies = map[string]probeStrategy{
+	"range": {Name: "range", Method: http.MethodGet, Range: "bytes=0-1023"}, // 小范围 GET
+	"head":  {Name: "head", Method: http.MethodHead},                        // HEAD
+	"open":  {Name: "open", Method: http.MethodGet, Range: "bytes=0-"},      // 开放范围 GET，读到响应头后中断，适合拒绝小范围请求的源站
+	"full":  {Name: "full", Method: http.MethodGet},                         // 完整 GET，读到响应头后中断
+}
+
+// hostProbeStrategies 按上游主机记录上一次成功的探测方式，下次优先使用
+var hostProbeStrategies = cache.New(6*time.Hour, 30*time.Minute)
+
+// parseProbeStrategies 解析 probe-strategies 参数
+func parseProbeStrategies(s string) ([]string, error) {
+	names := splitList(s)
+	if len(names) == 0 {
+		return nil, fmt.Errorf("probe-strategies 不能为空")
+	}
+	for _, name := range names {
+		if _, ok := probeStrategies[name]; !ok {
+			return nil, fmt.Errorf("无效的 probe-strategies 参数: %s (可选 range / head / open / full)", name)
+		}
+	}
+	return names, nil
+}
+
+// probeResult 探测结果。HasBody 为 false 时（HEAD）没有响应体，需要转发完整内容时要重新请求
+type probeResult struct {
+	Resp     *resty.Response
+	Strategy string
+	HasBody  bool
+}
+
+// probeUpstream 依次尝试各探测方式，直到得到可用的头信息：带 Range 的方式需要返回 206 和有效的 Content-Range，
+// 返回 200 说明上游忽略了 Range，同样可用但去掉 Accept-Ranges 按不支持 Range 处理；head 需要返回 2xx 和 Content-Length；
+// full 返回 2xx 即可。网络错误直接返回，全部方式都不可用时返回最后一个响应，由调用方按状态码报错
+func probeUpstream(ctx context.Context, cfg *Config, url string, header map[string][]string, jar *cookiejar.Jar) (*probeResult, error) {
+	host := ""
+	if u, err := handleUrl.Parse(url); err == nil {
+		host = u.Host
+	}
+	names := cfg.probeStrategies
+	if remembered, ok := hostProbeStrategies.Get(host); ok {
+		// 记住的方式放在最前面，失败时继续尝试其余方式
+		ordered := []string{remembered.(string)}
+		for _, name := range names {
+			if name != remembered.(string) {
+				ordered = append(ordered, name)
+			}
+		}
+		names = ordered
+	}
+
+	log := requestLogger(ctx)
+	var last *probeResult
+	for _, name := range names {
+		strategy := probeStrategies[name]
+		resp, err := probeOnce(ctx, cfg, strategy, url, header, jar)
+		if last != nil {
+			last.Resp.RawBody().Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		last = &probeResult{Resp: resp, Strategy: name, HasBody: strategy.Method != http.MethodHead}
+
+		status := resp.StatusCode()
+		usable := status >= 200 && status < 300
+		switch {
+		case strategy.Range != "" && status == http.StatusOK:
+			resp.Header().Del("Accept-Ranges")
+		case strategy.Range != "":
+			_, _, _, crErr := parseContentRange(resp.Header().Get("Content-Range"))
+			usable = status == http.StatusPartialContent && crErr == nil
+		case strategy.Method == http.MethodHead:
+			usable = usable && resp.RawResponse.ContentLength >= 0
+		}
+		if usable {
+			hostProbeStrategies.SetDefault(host, name)
+			return last, nil
+		}
+		log.Debugf("探测方式 %s 不可用 (statusCode: %d, Content-Range: %q)，尝试下一种", name, status, resp.Header().Get("Content-Range"))
+	}
+	return last, nil
+}
+
+func probeOnce(ctx context.Context, cfg *Config, strategy probeStrategy, url string, header map[string][]string, jar *cookiejar.Jar) (*resty.Response, error) {
+	probeCtx, probeSpan := tracer().Start(ctx, "probe", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("probe.strategy", strategy.Name)))
+	// 创建专用的客户端用于获取头信息，避免修改全局设置
+	r := cfg.clients.NewRestyClient().
+		SetTimeout(30 * time.Second).
+		SetRetryCount(3).
+		SetCookieJar(jar).
+		R().
+		SetContext(withClientTrace(probeCtx)).
+		SetDoNotParseResponse(true).
+		SetOutput(os.DevNull).
+		SetHeaderMultiValues(header)
+	if strategy.Range != "" {
+		r.SetHeader("Range", strategy.Range)
+	} else {
+		r.Header.Del("Range")
+	}
+	lease, err := hostLimits.acquire(ctx, cfg, url, false)
+	if err != nil {
+		endSpan(probeSpan, err)
+		return nil, err
+	}
+	resp, err := r.Execute(strategy.Method, url)
+	if err == nil {
+		lease.done(resp.StatusCode(), nil)
+	} else {
+		lease.done(0, err)
+	}
+	if err == nil {
+		probeSpan.SetAttributes(
+			attribute.Int("http.status_code", resp.StatusCode()),
+			attribute.String("http.content_range", resp.Header().Get("Content-Range")),
+		)
+	}
+	endSpan(probeSpan, err)
+	return resp, err
+}
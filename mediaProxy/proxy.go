@@ -5,11 +5,12 @@ import (
 
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"embed"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
 	"io"
 	"net/http"
@@ -19,9 +20,11 @@ import (
 	"os/signal"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -32,14 +35,15 @@ import (
 	"github.com/go-resty/resty/v2"
 	"github.com/patrickmn/go-cache"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //go:embed static
 var indexHTML embed.FS
 
 var mediaCache = cache.New(4*time.Hour, 10*time.Minute)
-var authKey string
-var enableContentTypeGuess bool
 
 const (
 	AppVersion = "V1.0.1 20260322"
@@ -89,14 +93,29 @@ type ProxyDownloadStruct struct {
 	ReadyChunkQueue      chan *Chunk
 	ThreadCount          int64
 	DownloadUrl          string
+	Scope                string // 缓存作用域，见 upstreamScope
+	SourceUrl            string // 当前使用的直链，刷新后与 DownloadUrl 不同
+	TargetUrl            string // 分片请求实际访问的地址，探测时解析出重定向终点后与 SourceUrl 不同
+	LinkHeader           map[string]string
+	Mirrors              *mirrorSet
+	RefreshUrl           string
+	refreshMutex         sync.Mutex
+	lastRefresh          time.Time
+	Validators           fileValidators
 	CookieJar            *cookiejar.Jar
 	Ctx                  context.Context
 	Cancel               context.CancelFunc
+	Cfg                  *Config
+	Log                  *logrus.Entry
+	ActiveWorkers        atomic.Int64
+	BufferedBytes        atomic.Int64
+	BufferedChunks       atomic.Int64 // 已下载完成、等待发送的分片数，ReadyChunkQueue 中还包含下载中的分片
 }
 
-func newProxyDownloadStruct(parentCtx context.Context, downloadUrl string, proxyTimeout int64, maxBuferredChunk int64, chunkSize int64, startOffset int64, endOffset int64, numTasks int64, cookiejar *cookiejar.Jar) *ProxyDownloadStruct {
+func newProxyDownloadStruct(parentCtx context.Context, cfg *Config, downloadUrl string, proxyTimeout int64, maxBuferredChunk int64, chunkSize int64, startOffset int64, endOffset int64, numTasks int64, cookiejar *cookiejar.Jar) *ProxyDownloadStruct {
 	ctx, cancel := context.WithCancel(parentCtx)
 	return &ProxyDownloadStruct{
+		Cfg:                  cfg,
 		ProxyRunning:         true,
 		MaxBufferedChunk:     int64(maxBuferredChunk),
 		ProxyTimeout:         proxyTimeout,
@@ -109,13 +128,23 @@ func newProxyDownloadStruct(parentCtx context.Context, downloadUrl string, proxy
 		EndOffset:            endOffset,
 		ThreadCount:          numTasks,
 		DownloadUrl:          downloadUrl,
+		SourceUrl:            downloadUrl,
+		TargetUrl:            downloadUrl,
 		CookieJar:            cookiejar,
 		Ctx:                  ctx,
 		Cancel:               cancel,
 	}
 }
 
-func ConcurrentDownload(ctx context.Context, downloadUrl string, rangeStart int64, rangeEnd int64, fileSize int64, splitSize int64, numTasks int64, emitter *base.Emitter, req *http.Request) {
+func ConcurrentDownload(ctx context.Context, cfg *Config, downloadUrl string, rangeStart int64, rangeEnd int64, validators fileValidators, splitSize int64, numTasks int64, emitter *base.Emitter, req *http.Request) {
+	log := requestLogger(ctx)
+	ctx, span := tracer().Start(ctx, "ConcurrentDownload", trace.WithAttributes(
+		attribute.Int64("range.start", rangeStart),
+		attribute.Int64("range.end", rangeEnd),
+		attribute.Int64("threads", numTasks),
+		attribute.Int64("chunk_size", splitSize),
+	))
+	defer span.End()
 	jar, _ := cookiejar.New(nil)
 	cookies := req.Cookies()
 	if len(cookies) > 0 {
@@ -131,16 +160,42 @@ func ConcurrentDownload(ctx context.Context, downloadUrl string, rangeStart int6
 	}
 
 	// 协程、读取超时设置
-	proxyTimeout := int64(10)
+	proxyTimeout := cfg.ProxyTimeout
 
-	logrus.Debugf("正在处理: %+v, rangeStart: %+v, rangeEnd: %+v, contentLength :%+v, splitSize: %+v, numSplits: %+v, numTasks: %+v", downloadUrl, rangeStart, rangeEnd, totalLength, splitSize, numSplits, numSplits)
-	maxChunks := int64(128*1024*1024) / splitSize
-	p := newProxyDownloadStruct(ctx, downloadUrl, proxyTimeout, maxChunks, splitSize, rangeStart, rangeEnd, numTasks, jar)
+	log.Debugf("正在处理: %+v, rangeStart: %+v, rangeEnd: %+v, contentLength :%+v, splitSize: %+v, numSplits: %+v, numTasks: %+v", downloadUrl, rangeStart, rangeEnd, totalLength, splitSize, numSplits, numSplits)
+	maxChunks := cfg.MaxBufferSize / splitSize
+	if maxChunks < 1 {
+		maxChunks = 1
+	}
+	p := newProxyDownloadStruct(ctx, cfg, downloadUrl, proxyTimeout, maxChunks, splitSize, rangeStart, rangeEnd, numTasks, jar)
+	p.Log = log
+	p.Validators = validators
+	p.RefreshUrl = refreshParam(req)
+	p.Scope = refreshScope(ctx, upstreamScope(downloadUrl, req.Header), p.RefreshUrl)
+	p.Mirrors = newMirrorSet(cachedMirrors(ctx, p.Scope, req))
+	if p.Mirrors.len() > 1 {
+		log.Debugf("%v 有 %d 个可用镜像，分片按速度分配", redactURL(downloadUrl), p.Mirrors.len()-1)
+	}
+	if link, ok := cachedRefresh(p.Scope, p.RefreshUrl); ok {
+		// 之前刷新过直链，继续使用新直链
+		p.SourceUrl, p.TargetUrl, p.LinkHeader = link.URL, link.URL, link.Header
+		p.Validators.ETag, p.Validators.LastModified = "", ""
+	}
+	if resolved, ok := cachedRedirect(p.Scope); ok && resolved.URL != p.SourceUrl {
+		// 直接请求探测时解析出的重定向终点，并带上重定向过程中拿到的 Cookie
+		if u, err := handleUrl.Parse(resolved.URL); err == nil {
+			jar.SetCookies(u, resolved.Cookies)
+			p.TargetUrl = resolved.URL
+		}
+	}
 	for numSplit := 0; numSplit < int(numSplits); numSplit++ {
 		go p.ProxyWorker(req)
 	}
 
+	session := sessions.Register(ctx, p, emitter, downloadUrl, clientAddr(req))
+	log.Debugf("会话 %s 开始", session.ID)
 	defer func() {
+		sessions.Unregister(session)
 		p.ProxyStop()
 		emitter.Close() // 确保在函数结束时关闭emitter
 		p = nil
@@ -151,7 +206,7 @@ func ConcurrentDownload(ctx context.Context, downloadUrl string, rangeStart int6
 
 		if buffer == nil || len(buffer) == 0 {
 			p.ProxyStop()
-			logrus.Debugf("ProxyRead执行失败或返回空: buffer == nil? %v, len=%d", buffer == nil, len(buffer))
+			log.Debugf("ProxyRead执行失败或返回空: buffer == nil? %v, len=%d", buffer == nil, len(buffer))
 			buffer = nil
 			return
 		}
@@ -161,14 +216,18 @@ func ConcurrentDownload(ctx context.Context, downloadUrl string, rangeStart int6
 		// base.Emitter.Write 内部通过 io.Pipe 阻塞写入，
 		// 这样可以根据播放器的实际消费能力（网速/解码速度）来背压（backpressure）下载协程，
 		// 从而不会无意义地消耗带宽和内存。
-		_, err := emitter.Write(buffer)
+		writeStart := time.Now()
+		n, err := emitter.Write(buffer)
+		traceBlockedWrite(ctx, writeStart, n)
+		session.addDelivered(n)
+		metricBytesOut.Add(float64(n))
 
 		// 增加极微小的睡眠，让出 CPU 切片，帮助缓解瞬间高并发写入时播放器读取跟不上的缓冲暴涨
 		time.Sleep(1 * time.Millisecond)
 
 		if err != nil {
 			if !strings.Contains(err.Error(), "write on closed pipe") && !strings.Contains(err.Error(), "client disconnected") && !strings.Contains(err.Error(), "forcibly closed") && !errors.Is(err, syscall.EPIPE) && !errors.Is(err, syscall.ECONNRESET) {
-				logrus.Errorf("emitter写入失败, 错误: %+v", err)
+				log.Errorf("emitter写入失败, 错误: %+v", err)
 			}
 			p.ProxyStop()
 			buffer = nil
@@ -177,7 +236,7 @@ func ConcurrentDownload(ctx context.Context, downloadUrl string, rangeStart int6
 
 		if p.CurrentOffset > rangeEnd {
 			p.ProxyStop()
-			logrus.Debugf("所有服务已经完成大小: %+v", totalLength)
+			log.Debugf("所有服务已经完成大小: %+v", totalLength)
 			buffer = nil
 			return
 		}
@@ -200,7 +259,7 @@ func (p *ProxyDownloadStruct) ProxyRead() []byte {
 	case currentChunk = <-p.ReadyChunkQueue:
 		break
 	case <-time.After(time.Duration(p.ProxyTimeout) * time.Second):
-		logrus.Debugf("执行 ProxyRead 超时")
+		p.Log.Debugf("执行 ProxyRead 超时")
 		p.ProxyStop()
 		return nil
 	}
@@ -212,18 +271,20 @@ func (p *ProxyDownloadStruct) ProxyRead() []byte {
 	buffer := currentChunk.get(p.Ctx)
 	// 如果获取到 nil，说明该 chunk 下载失败（例如 416），停止代理并返回 nil
 	if buffer == nil {
-		logrus.Debugf("ProxyRead 接收到 nil buffer (可能因为 416 或其他错误)，停止并返回")
+		p.Log.Debugf("ProxyRead 接收到 nil buffer (可能因为 416 或其他错误)，停止并返回")
 		p.ProxyStop()
 		return nil
 	}
 
 	if len(buffer) == 0 {
-		logrus.Debugf("ProxyRead 接收到空 buffer (len=0)")
+		p.Log.Debugf("ProxyRead 接收到空 buffer (len=0)")
 		p.ProxyStop()
 		return nil
 	}
 
 	p.CurrentOffset += int64(len(buffer))
+	p.BufferedBytes.Add(-int64(len(buffer)))
+	p.BufferedChunks.Add(-1)
 	return buffer
 }
 
@@ -241,7 +302,67 @@ func (p *ProxyDownloadStruct) ProxyStop() {
 	}
 }
 
+// target 返回分片请求当前应访问的地址、重定向前的直链、额外的请求头和校验值，刷新直链后会变化
+func (p *ProxyDownloadStruct) target() (string, string, map[string]string, fileValidators) {
+	p.ProxyMutex.Lock()
+	defer p.ProxyMutex.Unlock()
+	return p.TargetUrl, p.SourceUrl, p.LinkHeader, p.Validators
+}
+
+// fallbackToSource 重定向终点返回 403/410（签名过期、CDN 节点失效等）时改回直链，之后的分片请求重新经过重定向；
+// used 是失败请求访问的地址，已经是直链时返回 false
+func (p *ProxyDownloadStruct) fallbackToSource(used string, statusCode int) bool {
+	p.ProxyMutex.Lock()
+	defer p.ProxyMutex.Unlock()
+	if used == p.SourceUrl {
+		return false
+	}
+	if p.TargetUrl == used {
+		p.Log.Warnf("重定向终点 %v 返回 %d，改用直链 %v", redactURL(p.TargetUrl), statusCode, redactURL(p.SourceUrl))
+		p.TargetUrl = p.SourceUrl
+		mediaCache.Delete(redirectKey(p.Scope))
+	}
+	return true
+}
+
+// refreshLink 直链过期时通过 refresh 回调获取新直链，之后的分片请求（包括失败的这个）改用新直链，播放不中断。
+// 多个分片同时失败时只请求一次回调；没有回调或刷新失败时返回 false
+func (p *ProxyDownloadStruct) refreshLink(used string, statusCode int) bool {
+	if p.RefreshUrl == "" {
+		return false
+	}
+	p.refreshMutex.Lock()
+	defer p.refreshMutex.Unlock()
+	if current, _, _, _ := p.target(); current != used {
+		// 其他分片已经刷新过
+		return true
+	}
+	if time.Since(p.lastRefresh) < minRefreshInterval {
+		return false
+	}
+	p.lastRefresh = time.Now()
+
+	p.Log.Infof("%v 返回 %d，直链可能已过期，从 %d 处刷新后继续", redactURL(used), statusCode, p.CurrentOffset)
+	link, err := callRefresh(p.Ctx, p.Cfg, p.RefreshUrl, p.DownloadUrl, p.Scope)
+	if err != nil {
+		p.Log.Warnf("刷新 %v 的直链失败: %v", redactURL(p.DownloadUrl), redactError(err))
+		return false
+	}
+	p.ProxyMutex.Lock()
+	defer p.ProxyMutex.Unlock()
+	p.SourceUrl, p.TargetUrl, p.LinkHeader = link.URL, link.URL, link.Header
+	// 新直链可能来自不同的 CDN 节点，ETag / Last-Modified 不一定相同，只校验文件大小
+	p.Validators.ETag, p.Validators.LastModified = "", ""
+	return true
+}
+
 func (p *ProxyDownloadStruct) ProxyWorker(req *http.Request) {
+	p.ActiveWorkers.Add(1)
+	defer p.ActiveWorkers.Add(-1)
+
+	var attempt chunkTrace
+	defer attempt.end("", nil)
+
 	for {
 		if !p.ProxyRunning {
 			break
@@ -265,9 +386,9 @@ func (p *ProxyDownloadStruct) ProxyWorker(req *http.Request) {
 		if startOffset <= p.EndOffset {
 			currentChunkSize := p.ChunkSize
 			// 动态分片：第一个分片强制缩小，以极大降低首包延迟，防止 IjkPlayer 超时
-			// 只有当原始 chunkSize 大于 256KB 时，首包才缩减到 256KB
-			if startOffset == p.startOffset && currentChunkSize > 256*1024 {
-				currentChunkSize = 256 * 1024
+			// 只有当原始 chunkSize 大于 first-chunk (默认 256KB) 时，首包才缩减
+			if startOffset == p.startOffset && currentChunkSize > p.Cfg.FirstChunkSize {
+				currentChunkSize = p.Cfg.FirstChunkSize
 			}
 
 			p.NextChunkStartOffset += currentChunkSize
@@ -299,33 +420,74 @@ func (p *ProxyDownloadStruct) ProxyWorker(req *http.Request) {
 				}
 				newHeader["Accept-Encoding"] = []string{"identity"}
 
-				maxRetries := 5
+				maxRetries := p.Cfg.MaxRetries
 				if startOffset < int64(1048576) || (p.EndOffset-startOffset)/p.EndOffset*1000 < 2 {
-					maxRetries = 10 // 增加重试次数
+					maxRetries = p.Cfg.MaxRetriesHead // 增加重试次数
 				}
 
 				var resp *resty.Response
 				var err error
 				var finalBody []byte
+				var retryReason string
+				var failedMirror *mirror
 				for retry := 0; retry < maxRetries; retry++ {
-					resp, err = base.RestyClient.
-						SetTimeout(30*time.Second).
+					if retry > 0 {
+						metricRetries.WithLabelValues(retryReason).Inc()
+						attempt.end(retryReason, err)
+					}
+					attemptCtx := attempt.start(p.Ctx, chunk, retry)
+					// 配置了多个出口地址时，每次分片请求轮询使用不同的出口
+					requestStart := time.Now()
+					target, source, linkHeader, validators := p.target()
+					applyLinkHeader(newHeader, linkHeader)
+					m := p.Mirrors.pick(failedMirror)
+					if !m.primary() {
+						// 不同镜像的 ETag / Last-Modified 不一定相同，只校验文件大小
+						target = m.URL
+						validators.ETag, validators.LastModified = "", ""
+					}
+					// 重定向终点或镜像在其他主机上时不带客户端的凭据头
+					header := headerForHost(newHeader, source, target)
+					// 同一上游主机的请求数和频率由所有会话共享限制，熔断时等待冷却结束
+					lease, leaseErr := hostLimits.acquire(attemptCtx, p.Cfg, target, true)
+					if leaseErr != nil {
+						p.Log.Debugf("任务被取消(等待上游名额期间): range=%d-%d", chunk.startOffset, chunk.endOffset)
+						return
+					}
+					requestStart = time.Now()
+					resp, err = p.Cfg.clients.NextChunkClient(p.CookieJar, time.Duration(p.Cfg.ChunkTimeout)*time.Second).
 						SetRetryCount(1).
-						SetCookieJar(p.CookieJar).
 						R().
-						SetContext(p.Ctx).
-						SetHeaderMultiValues(newHeader).
+						SetContext(attemptCtx).
+						SetHeaderMultiValues(header).
 						SetHeader("Range", rangeStr).
-						Get(p.DownloadUrl)
+						Get(target)
+					if err != nil {
+						lease.done(0, err)
+					} else {
+						lease.done(resp.StatusCode(), nil)
+					}
 
 					if err != nil {
 						// 检查是否是被取消的上下文
 						if errors.Is(err, context.Canceled) {
-							logrus.Debugf("任务被取消: range=%d-%d", chunk.startOffset, chunk.endOffset)
+							p.Log.Debugf("任务被取消: range=%d-%d", chunk.startOffset, chunk.endOffset)
 							resp = nil
 							return
 						}
-						logrus.Errorf("处理 %+v 链接 range=%d-%d 部分失败: %+v", p.DownloadUrl, chunk.startOffset, chunk.endOffset, err)
+						// 被目标地址策略禁止时重试没有意义
+						if errors.Is(err, base.ErrDestinationBlocked) {
+							p.Log.Warnf("处理链接 range=%d-%d 被禁止: %v", chunk.startOffset, chunk.endOffset, err)
+							observeChunkRequest(requestStart, 0, err)
+							resp = nil
+							break
+						}
+						p.Log.Errorf("处理 %+v 链接 range=%d-%d 部分失败: %+v", redactURL(target), chunk.startOffset, chunk.endOffset, redactError(err))
+						observeChunkRequest(requestStart, 0, err)
+						retryReason = "error"
+						if p.Mirrors.fail(m, p.Log.Warnf) {
+							failedMirror = m
+						}
 						select {
 						case <-p.Ctx.Done():
 							return
@@ -334,37 +496,86 @@ func (p *ProxyDownloadStruct) ProxyWorker(req *http.Request) {
 						resp = nil
 						continue
 					}
+					observeChunkRequest(requestStart, resp.StatusCode(), nil)
+					attempt.setResponse(resp.StatusCode(), len(resp.Body()))
 					if !strings.HasPrefix(resp.Status(), "20") {
 						if resp.StatusCode() == 503 || resp.StatusCode() == 429 {
+							retryReason = "throttled"
+							if p.Mirrors.fail(m, p.Log.Warnf) {
+								// 有其他地址时直接换地址，不再退避等待
+								failedMirror = m
+								resp = nil
+								continue
+							}
 							// 迅雷等网盘限制并发或请求过快，进行退避重试
-							logrus.Debugf("触发服务器限制(statusCode: %d)，等待重试... range=%d-%d", resp.StatusCode(), chunk.startOffset, chunk.endOffset)
+							p.Log.Debugf("触发服务器限制(statusCode: %d)，等待重试... range=%d-%d", resp.StatusCode(), chunk.startOffset, chunk.endOffset)
 							select {
 							case <-p.Ctx.Done():
-								logrus.Debugf("任务被取消(退避期间): range=%d-%d", chunk.startOffset, chunk.endOffset)
+								p.Log.Debugf("任务被取消(退避期间): range=%d-%d", chunk.startOffset, chunk.endOffset)
 								return
 							case <-time.After(time.Duration(2+retry) * time.Second):
 							} // 递增等待时间
 							resp = nil
 							continue
 						}
+						if isExpiredStatus(resp.StatusCode()) && m.primary() {
+							if p.fallbackToSource(target, resp.StatusCode()) {
+								retryReason = "redirect_expired"
+								resp = nil
+								continue
+							}
+							if p.refreshLink(target, resp.StatusCode()) {
+								retryReason = "link_refreshed"
+								resp = nil
+								continue
+							}
+						}
 						if resp.StatusCode() == 416 {
-							logrus.Debugf("处理 %+v 链接 range=%d-%d 到达文件末尾 (416)", p.DownloadUrl, chunk.startOffset, chunk.endOffset)
+							p.Log.Debugf("处理 %+v 链接 range=%d-%d 到达文件末尾 (416)", p.DownloadUrl, chunk.startOffset, chunk.endOffset)
 							resp = nil
 							break // 跳出重试循环，标记此 chunk 为结束
 						}
 
-						logrus.Debugf("处理 %+v 链接 range=%d-%d 部分失败, statusCode: %+v: %s", p.DownloadUrl, chunk.startOffset, chunk.endOffset, resp.StatusCode(), resp.String())
+						p.Log.Debugf("处理 %+v 链接 range=%d-%d 部分失败, statusCode: %+v: %s", redactURL(target), chunk.startOffset, chunk.endOffset, resp.StatusCode(), resp.String())
+						if p.Mirrors.fail(m, p.Log.Warnf) {
+							// 还有其他地址，分片改由其他地址下载
+							failedMirror = m
+							retryReason = "mirror_failed"
+							resp = nil
+							continue
+						}
 						resp = nil
 						break // 跳出重试循环，标记此 chunk 失败
 					}
 
+					// 校验 ETag / Last-Modified / 文件总大小，不一致说明上游文件已变化（或 CDN 节点返回了过期页面），
+					// 继续拼接会导致播放器收到前后不一致的数据，作为致命错误结束会话
+					if mismatch := validators.check(resp.StatusCode(), resp.Header()); mismatch != nil && !m.primary() {
+						// 镜像的文件与主地址不一致，不再使用该镜像
+						p.Log.Warnf("镜像 %v 的分片 range=%d-%d 与探测时的文件不一致: %v", redactURL(m.URL), chunk.startOffset, chunk.endOffset, mismatch)
+						p.Mirrors.disable(m, p.Log.Warnf)
+						failedMirror = m
+						retryReason = "mirror_failed"
+						resp = nil
+						continue
+					} else if mismatch != nil {
+						p.Log.Errorf("【致命错误】分片 range=%d-%d 与探测时的文件不一致: %v，结束会话", chunk.startOffset, chunk.endOffset, mismatch)
+						err = mismatch
+						metricValidatorMismatches.Inc()
+						invalidateHeaders(p.Scope)
+						resp = nil
+						break
+					}
+
 					// 检查数据长度
 					body := resp.Body()
 					expectedLen := int(chunk.endOffset - chunk.startOffset + 1)
+					metricBytesIn.Add(float64(len(body)))
 
 					if resp.StatusCode() == 200 && chunk.startOffset > 0 {
-						logrus.Warnf("【警告】请求部分数据 range=%d-%d 但服务器返回 200 OK (全量数据), 丢弃并重试", chunk.startOffset, chunk.endOffset)
+						p.Log.Warnf("【警告】请求部分数据 range=%d-%d 但服务器返回 200 OK (全量数据), 丢弃并重试", chunk.startOffset, chunk.endOffset)
 						err = fmt.Errorf("server returned 200 instead of 206")
+						retryReason = "full_response"
 						resp = nil
 						select {
 						case <-p.Ctx.Done():
@@ -379,8 +590,10 @@ func (p *ProxyDownloadStruct) ProxyWorker(req *http.Request) {
 					if respContentRange != "" && resp.StatusCode() == 206 {
 						expectedPrefix := fmt.Sprintf("bytes %d-", chunk.startOffset)
 						if !strings.HasPrefix(respContentRange, expectedPrefix) {
-							logrus.Warnf("【致命警告】CDN返回的Range偏移量错误! 期望: %s, 实际: %s. 丢弃并重试以防止播放器画面卡死", expectedPrefix, respContentRange)
+							p.Log.Warnf("【致命警告】CDN返回的Range偏移量错误! 期望: %s, 实际: %s. 丢弃并重试以防止播放器画面卡死", expectedPrefix, respContentRange)
 							err = fmt.Errorf("invalid content-range: %s", respContentRange)
+							metricRangeMismatches.Inc()
+							retryReason = "content_range"
 							resp = nil
 							select {
 							case <-p.Ctx.Done():
@@ -392,8 +605,10 @@ func (p *ProxyDownloadStruct) ProxyWorker(req *http.Request) {
 					}
 
 					if len(body) < expectedLen {
-						logrus.Warnf("【警告】收到数据长度不足! 请求 range=%d-%d (预期 %d), 实际收到 %d bytes, 丢弃并重试", chunk.startOffset, chunk.endOffset, expectedLen, len(body))
+						p.Log.Warnf("【警告】收到数据长度不足! 请求 range=%d-%d (预期 %d), 实际收到 %d bytes, 丢弃并重试", chunk.startOffset, chunk.endOffset, expectedLen, len(body))
 						err = fmt.Errorf("short read: %d < %d", len(body), expectedLen)
+						metricShortReads.Inc()
+						retryReason = "short_read"
 						resp = nil
 						select {
 						case <-p.Ctx.Done():
@@ -402,24 +617,28 @@ func (p *ProxyDownloadStruct) ProxyWorker(req *http.Request) {
 						}
 						continue
 					} else if len(body) > expectedLen {
-						logrus.Debugf("收到数据长度超长 (预期 %d, 实际 %d), 进行截断", expectedLen, len(body))
+						p.Log.Debugf("收到数据长度超长 (预期 %d, 实际 %d), 进行截断", expectedLen, len(body))
 						finalBody = body[:expectedLen]
 					} else {
 						finalBody = body
 					}
+					p.Mirrors.succeed(m, len(finalBody), time.Since(requestStart))
 
 					break
 				}
 
 				if err != nil && resp == nil && finalBody == nil {
-					logrus.Errorf("处理链接 range=%d-%d 最终失败: %+v", chunk.startOffset, chunk.endOffset, err)
+					p.Log.Errorf("处理链接 range=%d-%d 最终失败: %+v", chunk.startOffset, chunk.endOffset, err)
 				}
+				attempt.end("", err)
 
 				// 接收数据
 				if finalBody != nil {
+					p.BufferedBytes.Add(int64(len(finalBody)))
+					p.BufferedChunks.Add(1)
 					chunk.put(finalBody)
 				} else {
-					logrus.Debugf("Chunk range=%d-%d 无法获取数据，写入 nil 并停止调度新任务", chunk.startOffset, chunk.endOffset)
+					p.Log.Debugf("Chunk range=%d-%d 无法获取数据，写入 nil 并停止调度新任务", chunk.startOffset, chunk.endOffset)
 					chunk.put(nil) // 放入 nil 标记此 chunk 失败或结束
 
 					// 停止调度新的 chunk
@@ -438,6 +657,20 @@ func (p *ProxyDownloadStruct) ProxyWorker(req *http.Request) {
 	}
 }
 
+// trialRangeEnd 返回网盘试看参数 rg=0-82432800 的结束位置，没有该参数时返回 -1
+func trialRangeEnd(url string) int64 {
+	parsedUrl, err := handleUrl.Parse(url)
+	if err != nil {
+		return -1
+	}
+	rgMatch := regexp.MustCompile(`[0-9]+-([0-9]+)`).FindStringSubmatch(parsedUrl.Query().Get("rg"))
+	if rgMatch == nil {
+		return -1
+	}
+	rgEnd, _ := strconv.ParseInt(rgMatch[1], 10, 64)
+	return rgEnd
+}
+
 func guessContentType(url string, contentDisposition string) string {
 	var fileName string
 	contentDisposition = strings.ToLower(contentDisposition)
@@ -487,10 +720,11 @@ func guessContentType(url string, contentDisposition string) string {
 }
 
 func handleMethod(w http.ResponseWriter, req *http.Request) {
+	log := requestLogger(req.Context())
 	switch req.Method {
 	case http.MethodGet, http.MethodHead:
 		// 处理 GET 和 HEAD 请求
-		logrus.Info("正在 GET/HEAD 请求")
+		log.Info("正在 GET/HEAD 请求")
 		// 检查查询参数是否为空
 		if req.URL.RawQuery == "" {
 			if req.Method == http.MethodGet {
@@ -509,14 +743,20 @@ func handleMethod(w http.ResponseWriter, req *http.Request) {
 		}
 	default:
 		// 处理其他方法的请求
-		logrus.Infof("正在处理 %v 请求", req.Method)
+		log.Infof("正在处理 %v 请求", req.Method)
 		handleOtherMethod(w, req)
 	}
 }
 
 func handleGetMethod(w http.ResponseWriter, req *http.Request) {
+	log := requestLogger(req.Context())
+	ctx, span := startRequestSpan(req, "handleGetMethod")
+	defer span.End()
 
-	logrus.Debugf("当前活跃的协程数量: %d", runtime.NumGoroutine())
+	log.Debugf("当前活跃的协程数量: %d", runtime.NumGoroutine())
+
+	// 本次会话使用的配置快照，热重载只影响之后的新会话
+	cfg := getConfig()
 
 	var url string
 	query := req.URL.Query()
@@ -526,16 +766,21 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 	if strHeader == "" {
 		strHeader = query.Get("header")
 	}
-	strAuth := query.Get("auth")
 	strThread := req.URL.Query().Get("thread")
 	strSplitSize := req.URL.Query().Get("size")
 	if strSplitSize == "" {
 		strSplitSize = req.URL.Query().Get("chunkSize")
 	}
+	strH3 := query.Get("h3")
+
+	// 条件请求由代理按缓存的校验值在本地处理
+	conds := takeConditions(req)
 
-	// 验证auth参数
-	if authKey != "" && strAuth != authKey {
-		http.Error(w, "无效的认证参数", http.StatusUnauthorized)
+	// 验证签名或 auth 参数
+	key, authErr := authenticate(cfg, req)
+	if authErr != nil {
+		log.Warnf("拒绝来自 %s 的请求: %v", clientAddr(req), authErr)
+		writeAccessError(w, authErr)
 		return
 	}
 
@@ -552,6 +797,23 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "缺少url参数", http.StatusBadRequest)
 		return
 	}
+	setUpstreamHost(req.Context(), url)
+
+	// 按密钥的限制检查并统计流量
+	if key != nil {
+		setRequestKey(req.Context(), key.Label)
+	}
+	mw, admitErr := admitKey(w, req, key, url)
+	if admitErr != nil {
+		log.Warnf("拒绝来自 %s 的请求: %v", clientAddr(req), admitErr)
+		writeAccessError(w, admitErr)
+		return
+	}
+	w = mw
+	ctx = keyContext(ctx, key)
+	if parsedUrl, err := handleUrl.Parse(url); err == nil {
+		span.SetAttributes(attribute.String("upstream.host", parsedUrl.Host))
+	}
 
 	if strHeader != "" {
 		if strForm == "base64" {
@@ -579,6 +841,8 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 			newHeader[name] = value
 		}
 	}
+	refreshURL := refreshParam(req)
+	scope := refreshScope(ctx, upstreamScope(url, req.Header), refreshURL)
 	// 强制要求服务器不进行 gzip 压缩，否则可能导致分片数据大小不匹配
 	newHeader["Accept-Encoding"] = []string{"identity"}
 	// ExoPlayer 请求时可能会带上一些额外的控制头，这里我们保留必要的，但要确保我们以原样拉取
@@ -594,17 +858,29 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 		jar.SetCookies(u, cookies)
 	}
 
+	// h3=1/0 可按请求覆盖全局的 HTTP/3 设置，探测请求和分片请求都会使用
+	if strH3 != "" {
+		ctx = base.WithHTTP3(ctx, strH3 == "1" || strH3 == "true")
+	}
+
 	var statusCode int
 	var rangeStart, rangeEnd = int64(0), int64(-1)
 	var isSuffixRange bool
 	var suffixLength int64
 	var isExactRange bool
 	var originalRequestRange string
+	var multiRanges []rangeSpec
 
 	requestRange := req.Header.Get("Range")
 	originalRequestRange = requestRange
 
-	if requestRange != "" {
+	if strings.Contains(requestRange, ",") {
+		// 多个范围，在得到文件大小后再计算实际范围；格式错误时忽略 Range 头
+		if multiRanges = parseRangeHeader(requestRange); multiRanges == nil {
+			requestRange = ""
+		}
+		statusCode = 200
+	} else if requestRange != "" {
 		suffixRegex := regexp.MustCompile(`bytes= *-([0-9]+)`)
 		rangeRegex := regexp.MustCompile(`bytes= *([0-9]+) *- *([0-9]*)`)
 
@@ -633,10 +909,25 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 		rangeEnd = -1
 	}
 
+	// 不支持 Range 的上游已经落盘时直接从落盘文件响应
+	if cfg.SpoolDir != "" {
+		if sp := spools.acquire(scope); sp != nil {
+			release, ok := startKeySession(w, req, key)
+			if !ok {
+				sp.release()
+				return
+			}
+			defer release()
+			serveSpool(ctx, w, req, sp, conds)
+			return
+		}
+	}
+
 	// 提前处理 Content-Type 以防影响缓存逻辑
 	// 注意：缓存查询等其他逻辑保留
 
-	cacheTimeKey := url + "#LastModified"
+	// 头信息按 scope 缓存：不同请求头（凭据）或不同 refresh 回调得到的文件可能不同
+	cacheTimeKey := scope + "#LastModified"
 	lastModifiedCache, found := mediaCache.Get(cacheTimeKey)
 	var lastModified int64
 	if found {
@@ -645,7 +936,7 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 		lastModified = int64(0)
 	}
 
-	headersKey := url + "#Headers"
+	headersKey := scope + "#Headers"
 	curTime := time.Now().Unix()
 	var cachedHeaders interface{}
 	cachedHeaders, found = mediaCache.Get(headersKey)
@@ -658,39 +949,77 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	if found && curTime-lastModified <= 60 {
+		metricCache.WithLabelValues("hit").Inc()
+	} else {
+		metricCache.WithLabelValues("miss").Inc()
+	}
+	span.SetAttributes(attribute.Bool("cache.hit", found && curTime-lastModified <= 60))
+
 	if !found || curTime-lastModified > 60 {
-		// 创建专用的客户端用于获取头信息，避免修改全局设置
-		headClient := base.NewRestyClient()
-		resp, err := headClient.
-			SetTimeout(30*time.Second).
-			SetRetryCount(3).
-			SetCookieJar(jar).
-			R().
-			SetDoNotParseResponse(true).
-			SetOutput(os.DevNull).
-			SetHeaderMultiValues(newHeader).
-			SetHeader("Range", "bytes=0-1023").
-			Get(url)
+		// 之前刷新过直链时继续使用新直链，旧地址多半已经过期
+		source := url
+		if link, ok := cachedRefresh(scope, refreshURL); ok {
+			source = link.URL
+			applyLinkHeader(newHeader, link.Header)
+		}
+
+		// 先解析重定向链，之后的探测和分片请求直接访问终点
+		target, resolved, probe, err := resolveAndProbe(ctx, cfg, source, newHeader, jar)
+		if err == nil && refreshURL != "" && isExpiredStatus(probe.Resp.StatusCode()) {
+			// 签名链接已过期，通过刷新回调获取新的直链
+			if link, refreshErr := callRefresh(ctx, cfg, refreshURL, url, scope); refreshErr == nil {
+				probe.Resp.RawBody().Close()
+				source = link.URL
+				applyLinkHeader(newHeader, link.Header)
+				target, resolved, probe, err = resolveAndProbe(ctx, cfg, source, newHeader, jar)
+			} else {
+				log.Warnf("刷新 %v 的直链失败: %v", redactURL(url), refreshErr)
+			}
+		}
+		var resp *resty.Response
+		if err == nil {
+			resp = probe.Resp
+		}
+		if errors.Is(err, base.ErrDestinationBlocked) {
+			log.Warnf("拒绝来自 %s 的请求: %v", clientAddr(req), err)
+			span.SetStatus(codes.Error, err.Error())
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if writeCircuitOpen(w, err) {
+			log.Warnf("获取 %v 头信息失败: %v", redactURL(url), redactError(err))
+			span.SetStatus(codes.Error, err.Error())
+			return
+		}
 		if err != nil {
-			http.Error(w, fmt.Sprintf("下载 %v 链接失败: %v", url, err), http.StatusInternalServerError)
+			log.Errorf("获取 %v 头信息失败: %v", redactURL(url), redactError(err))
+			span.SetStatus(codes.Error, redactError(err))
+			http.Error(w, fmt.Sprintf("下载 %v 链接失败: %v", redactURL(url), redactError(err)), http.StatusInternalServerError)
 			return
 		}
 		if resp.StatusCode() < 200 || resp.StatusCode() >= 400 {
+			log.Warnf("获取 %v 头信息失败, statusCode: %d", redactURL(url), resp.StatusCode())
 			http.Error(w, resp.Status(), resp.StatusCode())
 			return
 		}
 
+		if found && validatorsChanged(responseHeaders, resp.Header()) {
+			log.Infof("%v 的 ETag / Last-Modified 已变化，使用新的头信息", redactURL(url))
+		}
+
 		// 深拷贝以防止修改缓存
 		responseHeaders = make(http.Header)
 		for k, v := range resp.Header() {
 			responseHeaders[k] = append([]string(nil), v...)
 		}
 
-		logrus.Debugf("请求头: %+v", responseHeaders)
+		responseHeaders.Set(ProbeStrategyHeader, probe.Strategy)
+		log.Debugf("请求头: %+v", responseHeaders)
 
 		contentType := responseHeaders.Get("Content-Type")
 		if contentType == "" || contentType == "application/octet-stream" {
-			if enableContentTypeGuess {
+			if cfg.GuessType {
 				guessedType := guessContentType(url, responseHeaders.Get("Content-Disposition"))
 				if guessedType != "" {
 					responseHeaders.Set("Content-Type", guessedType)
@@ -706,49 +1035,108 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 		}
 
 		contentRange := responseHeaders.Get("Content-Range")
+		acceptRange := responseHeaders.Get("Accept-Ranges")
+		unknownSize := contentRange == "" && acceptRange == "bytes" && resp.RawResponse.ContentLength < 0
+		if contentRange != "" {
+			_, _, contentSize, err := parseContentRange(contentRange)
+			if err != nil {
+				resp.RawBody().Close()
+				log.Warnf("获取 %v 头信息失败: %v", redactURL(url), redactError(err))
+				http.Error(w, "上游返回的 Content-Range 无效", http.StatusBadGateway)
+				return
+			}
+			unknownSize = contentSize < 0
+		}
+		if unknownSize {
+			// 总大小未知 (bytes 0-1023/* 或没有 Content-Length)，单连接顺序转发
+			resp.RawBody().Close()
+			log.Debugf("%v 的总大小未知，顺序转发", redactURL(url))
+			done, ignoreRange := conds.apply(w, req.Method, requestRange != "", responseHeaders)
+			if done {
+				return
+			}
+			streamRange := originalRequestRange
+			if ignoreRange {
+				streamRange = ""
+			}
+			release, ok := startKeySession(w, req, key)
+			if !ok {
+				return
+			}
+			defer release()
+			serveUnknownSize(ctx, w, req, cfg, source, newHeader, jar, responseHeaders, streamRange)
+			return
+		}
 		if contentRange != "" {
-			matchGroup := regexp.MustCompile(`.*/([0-9]+)`).FindStringSubmatch(contentRange)
-			contentSize, _ := strconv.ParseInt(matchGroup[1], 10, 64)
+			_, _, contentSize, _ := parseContentRange(contentRange)
 
 			// 检查是否受限于网盘试看(如迅雷 rg=0-82432800)参数
-			parsedUrl, errUrl := handleUrl.Parse(url)
-			if errUrl == nil {
-				rg := parsedUrl.Query().Get("rg")
-				if rg != "" {
-					rgMatch := regexp.MustCompile(`[0-9]+-([0-9]+)`).FindStringSubmatch(rg)
-					if rgMatch != nil {
-						rgEnd, _ := strconv.ParseInt(rgMatch[1], 10, 64)
-						if rgEnd > 0 && rgEnd < contentSize {
-							contentSize = rgEnd + 1
-							logrus.Debugf("检测到 URL 包含试看范围限制 rg=%s，将文件总大小修正为: %d", rg, contentSize)
-
-							// 同步修改 responseHeaders 中的 Content-Range，防止后续重新解析出旧的 contentSize
-							oldContentRange := responseHeaders.Get("Content-Range")
-							if oldContentRange != "" {
-								newContentRange := regexp.MustCompile(`/([0-9]+)`).ReplaceAllString(oldContentRange, fmt.Sprintf("/%d", contentSize))
-								responseHeaders.Set("Content-Range", newContentRange)
-							}
-						}
-					}
+			if rgEnd := trialRangeEnd(url); rgEnd > 0 && rgEnd < contentSize {
+				contentSize = rgEnd + 1
+				log.Debugf("检测到 URL 包含试看范围限制，将文件总大小修正为: %d", contentSize)
+
+				// 同步修改 responseHeaders 中的 Content-Range，防止后续重新解析出旧的 contentSize
+				oldContentRange := responseHeaders.Get("Content-Range")
+				if oldContentRange != "" {
+					newContentRange := regexp.MustCompile(`/([0-9]+)`).ReplaceAllString(oldContentRange, fmt.Sprintf("/%d", contentSize))
+					responseHeaders.Set("Content-Range", newContentRange)
 				}
 			}
 
 			responseHeaders.Set("Content-Length", strconv.FormatInt(contentSize, 10))
+		} else if resp.RawResponse.ContentLength >= 0 {
+			responseHeaders.Set("Content-Length", strconv.FormatInt(resp.RawResponse.ContentLength, 10))
 		} else {
-			responseHeaders.Set("Content-Length", strconv.FormatInt(resp.Size(), 10))
+			responseHeaders.Del("Content-Length")
 		}
 
-		acceptRange := responseHeaders.Get("Accept-Ranges")
 		if contentRange == "" && acceptRange == "" {
 			// 不支持断点续传
 			remainingSize := 0
-			const maxBufferSize = 128 * 1024 * 1024 // 128MB
-			// const maxBufferSize = 1*1024 // 1KB
+			release, ok := startKeySession(w, req, key)
+			if !ok {
+				resp.RawBody().Close()
+				return
+			}
+			defer release()
+
+			// 开启落盘时在后台完整下载到临时文件，之后的拖动请求可以从已下载的部分响应
+			if length := resp.RawResponse.ContentLength; cfg.SpoolDir != "" && req.Method == http.MethodGet &&
+				(cfg.SpoolMaxSize == 0 || length <= cfg.SpoolMaxSize) {
+				sp, err := spools.start(ctx, cfg, scope, url, newHeader, jar, responseHeaders, length)
+				if err == nil {
+					resp.RawBody().Close()
+					log.Debugf("%v 不支持 Range，落盘到 %s", redactURL(url), sp.Path)
+					serveSpool(ctx, w, req, sp, conds)
+					return
+				}
+				log.Warnf("%v 落盘失败，直接转发: %v", redactURL(url), redactError(err))
+			}
+
+			if done, _ := conds.apply(w, req.Method, false, responseHeaders); done {
+				return
+			}
+			if !probe.HasBody && req.Method == http.MethodGet {
+				// 探测用的是 HEAD，没有响应体可以转发，重新完整请求
+				full, err := probeOnce(ctx, cfg, probeStrategies["full"], target, headerForHost(newHeader, source, target), jar)
+				if err != nil || full.StatusCode() != http.StatusOK {
+					if err == nil {
+						full.RawBody().Close()
+						err = fmt.Errorf("statusCode: %d", full.StatusCode())
+					}
+					log.Errorf("请求 %v 失败: %v", redactURL(url), redactError(err))
+					http.Error(w, fmt.Sprintf("下载 %v 链接失败: %v", redactURL(url), redactError(err)), http.StatusBadGateway)
+					return
+				}
+				resp.RawBody().Close()
+				resp = full
+				defer resp.RawBody().Close()
+			}
 
 			// 必须先写入 Header
 			responseHeaders.Del("Transfer-Encoding")
 			for key, values := range responseHeaders {
-				if strings.EqualFold(strings.ToLower(key), "connection") || strings.EqualFold(strings.ToLower(key), "proxy-connection") {
+				if isHopByHopHeader(key) {
 					continue
 				}
 				w.Header().Set(key, strings.Join(values, ","))
@@ -771,14 +1159,15 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 					remainingSize += n
 					// 写入数据到客户端
 					_, writeErr := w.Write(buf[:n])
+					metricBytesOut.Add(float64(n))
 					if writeErr != nil {
-						logrus.Errorf("向客户端写入 Response 失败: %v", writeErr)
+						log.Errorf("向客户端写入 Response 失败: %v", writeErr)
 						return
 					}
 				}
 				if err != nil {
 					if err != io.EOF {
-						logrus.Errorf("读取 Response Body 错误: %v", err)
+						log.Errorf("读取 Response Body 错误: %v", err)
 					}
 					break
 				}
@@ -795,16 +1184,33 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 			}
 			mediaCache.Set(headersKey, cacheHeaders, 1800*time.Second)
 			mediaCache.Set(cacheTimeKey, curTime, 1800*time.Second)
+			if target != source {
+				mediaCache.Set(redirectKey(scope), resolved, 1800*time.Second)
+			} else {
+				mediaCache.Delete(redirectKey(scope))
+			}
 		}
 
 		defer func() {
 			if resp != nil && resp.RawBody() != nil {
-				logrus.Debugf("resp.RawBody 已关闭")
+				log.Debugf("resp.RawBody 已关闭")
 				resp.RawBody().Close()
 			}
 		}()
 	}
 
+	if done, ignoreRange := conds.apply(w, req.Method, requestRange != "", responseHeaders); done {
+		return
+	} else if ignoreRange {
+		// If-Range 不匹配：文件已变化，返回完整内容
+		log.Debugf("If-Range 不匹配，忽略 Range: %s", originalRequestRange)
+		requestRange, originalRequestRange = "", ""
+		multiRanges = nil
+		statusCode = 200
+		rangeStart, rangeEnd = 0, -1
+		isSuffixRange, isExactRange = false, false
+	}
+
 	acceptRange := responseHeaders.Get("Accept-Ranges")
 	contentRange := responseHeaders.Get("Content-Range")
 	if contentRange == "" && acceptRange == "" && responseHeaders.Get("Content-Length") == "" {
@@ -816,12 +1222,40 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 		var splitSize int64
 		var numTasks int64
 
-		contentSize := int64(0)
-		matchGroup := regexp.MustCompile(`.*/([0-9]+)`).FindStringSubmatch(contentRange)
-		if matchGroup != nil {
-			contentSize, _ = strconv.ParseInt(matchGroup[1], 10, 64)
+		var contentSize int64
+		var sizeErr error
+		if contentRange != "" {
+			_, _, contentSize, sizeErr = parseContentRange(contentRange)
 		} else {
-			contentSize, _ = strconv.ParseInt(responseHeaders.Get("Content-Length"), 10, 64)
+			contentSize, sizeErr = strconv.ParseInt(responseHeaders.Get("Content-Length"), 10, 64)
+		}
+		if sizeErr != nil || contentSize < 0 {
+			// 缓存的头信息无法得到文件大小，删除缓存，下一个请求重新探测
+			invalidateHeaders(scope)
+			log.Warnf("缓存的 %v 头信息无效 (Content-Range: %q, Content-Length: %q)", redactURL(url), contentRange, responseHeaders.Get("Content-Length"))
+			http.Error(w, "上游返回的文件大小无效", http.StatusBadGateway)
+			return
+		}
+
+		validators := newFileValidators(responseHeaders, contentSize)
+		if trialRangeEnd(url) > 0 {
+			// 试看参数修正过文件总大小，分片响应中的总大小仍是原始值，不校验
+			validators.Size = 0
+		}
+
+		var ranges []byteRange
+		if multiRanges != nil {
+			ranges = resolveRanges(multiRanges, contentSize)
+			if len(ranges) == 0 {
+				log.Debugf("多个 Range 都超出文件大小，返回416错误. range: %s, contentSize: %d", originalRequestRange, contentSize)
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", contentSize))
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			// 合并后只剩一个范围时按普通的单范围响应
+			statusCode = 206
+			rangeStart, rangeEnd = ranges[0].Start, ranges[0].End
+			isExactRange = true
 		}
 
 		if isSuffixRange {
@@ -860,11 +1294,15 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 					numTasks = 1
 				}
 				// 限制最大线程数，防止被服务器封禁（尤其是迅雷等网盘）
-				if numTasks > 32 {
-					logrus.Debugf("请求线程数(%d)过大，限制为32以防止被封禁", numTasks)
-					numTasks = 32
+				if numTasks > cfg.MaxThreads {
+					log.Debugf("请求线程数(%d)过大，限制为%d以防止被封禁", numTasks, cfg.MaxThreads)
+					numTasks = cfg.MaxThreads
 				}
 			}
+			if key != nil && key.MaxThreads > 0 && numTasks > key.MaxThreads {
+				log.Debugf("线程数(%d)超过密钥 %s 的上限，限制为%d", numTasks, key.Label, key.MaxThreads)
+				numTasks = key.MaxThreads
+			}
 
 			if strSplitSize != "" {
 				// 处理带单位的参数，如 256K, 1M 等
@@ -894,18 +1332,33 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 				minSplitSize := int64(32 * 1024)
 
 				if splitSize > maxSplitSize {
-					logrus.Debugf("splitSize 超过上限 %d，强制调整为 %d", splitSize, maxSplitSize)
+					log.Debugf("splitSize 超过上限 %d，强制调整为 %d", splitSize, maxSplitSize)
 					splitSize = maxSplitSize
 				} else if splitSize < minSplitSize {
-					logrus.Debugf("splitSize 过小 %d，强制调整为最小 %d", splitSize, minSplitSize)
+					log.Debugf("splitSize 过小 %d，强制调整为最小 %d", splitSize, minSplitSize)
 					splitSize = minSplitSize
 				}
 			} else {
-				// 如果没有传，默认 128KB
-				splitSize = int64(128 * 1024)
+				// 如果没有传，使用 chunk-size (默认 128KB)
+				splitSize = cfg.DefaultChunkSize
 			}
 
-			logrus.Debugf("Proxy data transfer: thread=%d, splitSize=%d", numTasks, splitSize)
+			log.Debugf("Proxy data transfer: thread=%d, splitSize=%d", numTasks, splitSize)
+
+			release, ok := startKeySession(w, req, key)
+			if !ok {
+				return
+			}
+			defer release()
+			if req.Method != http.MethodHead {
+				// 校验本次请求提供的镜像，一致的镜像参与分片下载
+				prepareMirrors(ctx, cfg, scope, req, url, newHeader, jar, contentSize)
+			}
+
+			if len(ranges) > 1 {
+				serveMultiRange(ctx, w, req, cfg, url, responseHeaders, ranges, contentSize, validators, splitSize, numTasks)
+				return
+			}
 
 			// ExoPlayer 兼容性核心：如果请求中有 Range 且要求部分数据，必须返回 206
 			if requestRange != "" || statusCode == 206 {
@@ -946,7 +1399,7 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 			responseHeaders.Del("Content-Encoding")
 
 			for key, values := range responseHeaders {
-				if strings.EqualFold(strings.ToLower(key), "connection") || strings.EqualFold(strings.ToLower(key), "proxy-connection") {
+				if isHopByHopHeader(key) {
 					continue
 				}
 				w.Header().Set(key, strings.Join(values, ","))
@@ -969,21 +1422,21 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 			defer func() {
 				if !emitter.IsClosed() {
 					emitter.Close()
-					logrus.Debugf("handleGetMethod emitter 已关闭-支持断点续传")
+					log.Debugf("handleGetMethod emitter 已关闭-支持断点续传")
 				}
 			}()
 
-			go ConcurrentDownload(req.Context(), url, rangeStart, rangeEnd, contentSize, splitSize, numTasks, emitter, req)
+			go ConcurrentDownload(ctx, cfg, url, rangeStart, rangeEnd, validators, splitSize, numTasks, emitter, req)
 
 			// 响应数据，使用较小的 buffer 降低每次复制的吞吐量，配合背压防止 ExoPlayer 贪婪拉取导致带宽暴走
 			buf := make([]byte, 32*1024) // 减小 buffer 强制限制单次搬运速度
 			_, err := io.CopyBuffer(w, emitter, buf)
 			if err != nil && !strings.Contains(err.Error(), "write on closed pipe") && !strings.Contains(err.Error(), "client disconnected") && !strings.Contains(err.Error(), "forcibly closed") && !errors.Is(err, syscall.EPIPE) && !errors.Is(err, syscall.ECONNRESET) {
-				logrus.Debugf("io.Copy error: %v", err)
+				log.Debugf("io.Copy error: %v", err)
 			}
 		} else {
 			// Range超出文件大小，返回416错误
-			logrus.Debugf("Range超出文件大小，返回416错误. rangeStart: %d, rangeEnd: %d, contentSize: %d", rangeStart, rangeEnd, contentSize)
+			log.Debugf("Range超出文件大小，返回416错误. rangeStart: %d, rangeEnd: %d, contentSize: %d", rangeStart, rangeEnd, contentSize)
 			statusCode = 416
 			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", contentSize))
 			w.WriteHeader(statusCode)
@@ -993,17 +1446,28 @@ func handleGetMethod(w http.ResponseWriter, req *http.Request) {
 
 func handleOtherMethod(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
+	log := requestLogger(req.Context())
+
+	// 先校验方法，不支持的方法不占用密钥和上游主机的名额
+	switch req.Method {
+	case http.MethodPost, http.MethodPut, http.MethodOptions, http.MethodDelete, http.MethodPatch:
+	default:
+		http.Error(w, fmt.Sprintf("无效的Method: %v", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
 
 	var url string
 	query := req.URL.Query()
 	url = query.Get("url")
 	strForm := query.Get("form")
 	strHeader := query.Get("headers")
-	strAuth := query.Get("auth")
+	cfg := getConfig()
 
-	// 验证auth参数
-	if authKey != "" && strAuth != authKey {
-		http.Error(w, "无效的认证参数", http.StatusUnauthorized)
+	// 验证签名或 auth 参数
+	key, authErr := authenticate(cfg, req)
+	if authErr != nil {
+		log.Warnf("拒绝来自 %s 的请求: %v", clientAddr(req), authErr)
+		writeAccessError(w, authErr)
 		return
 	}
 
@@ -1020,6 +1484,20 @@ func handleOtherMethod(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "缺少 url 参数", http.StatusBadRequest)
 		return
 	}
+	setUpstreamHost(req.Context(), url)
+
+	// 按密钥的限制检查并统计流量
+	if key != nil {
+		setRequestKey(req.Context(), key.Label)
+	}
+	mw, admitErr := admitKey(w, req, key, url)
+	if admitErr != nil {
+		log.Warnf("拒绝来自 %s 的请求: %v", clientAddr(req), admitErr)
+		writeAccessError(w, admitErr)
+		return
+	}
+	w = mw
+	ctx := keyContext(req.Context(), key)
 
 	// 处理自定义 headers
 	var headers map[string]string
@@ -1066,57 +1544,68 @@ func handleOtherMethod(w http.ResponseWriter, req *http.Request) {
 		reqBody, _ = io.ReadAll(req.Body)
 	}
 
+	lease, err := hostLimits.acquire(ctx, cfg, url, false)
+	if err != nil {
+		log.Warnf("%v 链接 %v 失败: %v", req.Method, redactURL(url), redactError(err))
+		if !writeCircuitOpen(w, err) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+		return
+	}
 	var resp *resty.Response
-	var err error
 	switch req.Method {
 	case http.MethodPost:
-		resp, err = base.RestyClient.
-			SetTimeout(10 * time.Second).
+		resp, err = cfg.clients.RequestClient(jar, 10*time.Second).
 			SetRetryCount(3).
-			SetCookieJar(jar).
 			R().
+			SetContext(ctx).
 			SetBody(reqBody).
 			SetHeaderMultiValues(newHeader).
 			Post(url)
 	case http.MethodPut:
-		resp, err = base.RestyClient.
-			SetTimeout(10 * time.Second).
+		resp, err = cfg.clients.RequestClient(jar, 10*time.Second).
 			SetRetryCount(3).
-			SetCookieJar(jar).
 			R().
+			SetContext(ctx).
 			SetBody(reqBody).
 			SetHeaderMultiValues(newHeader).
 			Put(url)
 	case http.MethodOptions:
-		resp, err = base.RestyClient.
-			SetTimeout(10 * time.Second).
+		resp, err = cfg.clients.RequestClient(jar, 10*time.Second).
 			SetRetryCount(3).
-			SetCookieJar(jar).
 			R().
+			SetContext(ctx).
 			SetHeaderMultiValues(newHeader).
 			Options(url)
 	case http.MethodDelete:
-		resp, err = base.RestyClient.
-			SetTimeout(10 * time.Second).
+		resp, err = cfg.clients.RequestClient(jar, 10*time.Second).
 			SetRetryCount(3).
-			SetCookieJar(jar).
 			R().
+			SetContext(ctx).
 			SetHeaderMultiValues(newHeader).
 			Delete(url)
 	case http.MethodPatch:
-		resp, err = base.RestyClient.
-			SetTimeout(10 * time.Second).
+		resp, err = cfg.clients.RequestClient(jar, 10*time.Second).
 			SetRetryCount(3).
-			SetCookieJar(jar).
 			R().
+			SetContext(ctx).
 			SetHeaderMultiValues(newHeader).
 			Patch(url)
-	default:
-		http.Error(w, fmt.Sprintf("无效的Method: %v", req.Method), http.StatusBadRequest)
+	}
+	if err != nil {
+		lease.done(0, err)
+	} else {
+		lease.done(resp.StatusCode(), nil)
 	}
 
+	if errors.Is(err, base.ErrDestinationBlocked) {
+		log.Warnf("拒绝来自 %s 的请求: %v", clientAddr(req), err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("%v 链接 %v 失败: %v", req.Method, url, err), http.StatusInternalServerError)
+		log.Errorf("%v 链接 %v 失败: %v", req.Method, redactURL(url), redactError(err))
+		http.Error(w, fmt.Sprintf("%v 链接 %v 失败: %v", req.Method, redactURL(url), redactError(err)), http.StatusInternalServerError)
 		resp = nil
 		return
 	}
@@ -1127,8 +1616,13 @@ func handleOtherMethod(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// 处理响应
-	w.Header().Set("Connection", "close")
+	if req.ProtoMajor == 1 {
+		w.Header().Set("Connection", "close")
+	}
 	for name, values := range resp.Header() {
+		if isHopByHopHeader(name) {
+			continue
+		}
 		w.Header().Set(name, strings.Join(values, ","))
 	}
 	w.WriteHeader(resp.StatusCode())
@@ -1136,6 +1630,35 @@ func handleOtherMethod(w http.ResponseWriter, req *http.Request) {
 	io.Copy(w, bodyReader)
 }
 
+// isHopByHopHeader 判断是否为逐跳头部，这些头部不能转发给客户端，HTTP/2 下更是协议错误
+func isHopByHopHeader(key string) bool {
+	switch strings.ToLower(key) {
+	case "connection", "proxy-connection", "keep-alive", "transfer-encoding", "upgrade":
+		return true
+	}
+	return false
+}
+
+// upstreamScopeIgnored 每个请求都不同、且不影响上游响应的请求头，计算缓存作用域时忽略
+var upstreamScopeIgnored = map[string]bool{"Range": true, "X-Request-Id": true, "Traceparent": true, "Tracestate": true, "Connection": true}
+
+// upstreamScope 返回上游地址加上实际发给上游的请求头（含 Cookie）的摘要。重定向终点、刷新后的直链、镜像和落盘文件
+// 都是用请求方的凭据得到的，只能给带着相同请求头的请求使用，否则一个客户端的 Cookie 或签名链接会被用于其他客户端
+func upstreamScope(url string, header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		if !shouldFilterHeaderName(name) && !upstreamScopeIgnored[http.CanonicalHeaderKey(name)] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%q\x00", http.CanonicalHeaderKey(name), header[name])
+	}
+	return url + "#" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
 func shouldFilterHeaderName(key string) bool {
 	if len(strings.TrimSpace(key)) == 0 {
 		return false
@@ -1146,36 +1669,21 @@ func shouldFilterHeaderName(key string) bool {
 }
 
 func main() {
-	// 定义命令行参数
-	dns := flag.String("dns", "8.8.8.8", "DNS解析 IP:port")
-	port := flag.String("port", "5575", "服务器端口")
-	debug := flag.Bool("debug", false, "Debug模式")
-	auth := flag.String("auth", "", "认证密钥")
-	guessType := flag.Bool("guess-type", false, "是否根据URL强制猜测并设置 Content-Type (可能导致 MPV 等播放器拖拽失败，默认不启用)")
-
-	// 帮助和版本信息
-	showHelp := flag.Bool("h", false, "显示帮助信息")
-	showHelpLong := flag.Bool("help", false, "显示帮助信息")
-	showVersion := flag.Bool("v", false, "显示版本信息")
-	showVersionLong := flag.Bool("version", false, "显示版本信息")
-
-	// 自定义 Usage
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "drpyS专用多线程媒体代理服务 %s\n\n", AppVersion)
-		fmt.Fprintf(os.Stderr, "用法:\n")
-		fmt.Fprintf(os.Stderr, "  %s [参数]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "参数列表:\n")
-		flag.PrintDefaults()
-	}
-
-	flag.Parse()
-
-	if *showHelp || *showHelpLong {
-		flag.Usage()
+	args := os.Args[1:]
+	cfg, err := loadConfig(args)
+	if err != nil {
+		if !errors.Is(err, errBadArgs) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(2)
+	}
+
+	if cfg.ShowHelp {
+		newFlagSet(&Config{}).Usage()
 		return
 	}
 
-	if *showVersion || *showVersionLong {
+	if cfg.ShowVersion {
 		fmt.Printf("drpyS专用多线程媒体代理服务 %s\n", AppVersion)
 		return
 	}
@@ -1183,25 +1691,32 @@ func main() {
 	// 忽略 SIGPIPE 信号
 	signal.Ignore(syscall.SIGPIPE)
 
-	// 设置日志输出和级别
-	logrus.SetOutput(os.Stdout)
-	if *debug {
-		logrus.SetLevel(logrus.DebugLevel)
+	// 日志输出、级别和其他全局设置由 applyConfig 完成
+	if err := applyConfig(cfg); err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	if cfg.Debug {
 		logrus.Info("已开启Debug模式")
-	} else {
-		logrus.SetLevel(logrus.InfoLevel)
 	}
-	logrus.Infof("服务器运行在 %s 端口.", *port)
+	if cfg.ConfigFile != "" {
+		logrus.Infof("已加载配置文件: %s", cfg.ConfigFile)
+	}
+	go watchConfig(args)
+
+	// 退出前上报尚未发送的 span，保存密钥用量
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		<-sigChan
+		shutdownTracing()
+		keyStore.SaveUsage()
+		spools.Close()
+		os.Exit(0)
+	}()
 
-	// 设置全局变量
-	authKey = *auth
-	enableContentTypeGuess = *guessType
-	base.DnsResolverIP = *dns
-	base.InitClient()
-	var server = http.Server{
-		Addr:    ":" + *port,
-		Handler: http.HandlerFunc(handleMethod),
+	if err := runServer(newRouter(), cfg.serverOptions()); err != nil {
+		shutdownTracing()
+		keyStore.SaveUsage()
+		logrus.Fatalf("服务器退出: %v", err)
 	}
-	// server.SetKeepAlivesEnabled(false)
-	server.ListenAndServe()
 }
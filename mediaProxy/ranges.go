@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+
+	"MediaProxy/base"
+)
+
+// maxMultiRanges 单个请求最多接受的范围数，超过时忽略 Range 头按完整内容响应，防止被大量小范围放大请求
+const maxMultiRanges = 64
+
+// rangeSpec Range 头中的一个范围，Suffix 为 true 时表示最后 End 个字节，End 为 -1 表示到文件末尾
+type rangeSpec struct {
+	Start  int64
+	End    int64
+	Suffix bool
+}
+
+// byteRange 解析后的实际范围，包含两端
+type byteRange struct {
+	Start int64
+	End   int64
+}
+
+func (r byteRange) length() int64 {
+	return r.End - r.Start + 1
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.End, size)
+}
+
+// parseRangeHeader 按 RFC 7233 解析 Range 头中的全部范围；
+// 格式错误、单位不是 bytes 或范围过多时返回 nil，调用方应忽略 Range 头
+func parseRangeHeader(s string) []rangeSpec {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "bytes=") {
+		return nil
+	}
+	var specs []rangeSpec
+	for _, item := range strings.Split(strings.TrimPrefix(s, "bytes="), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(item, "-")
+		if !ok {
+			return nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		if first == "" {
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil
+			}
+			specs = append(specs, rangeSpec{End: n, Suffix: true})
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil
+		}
+		end := int64(-1)
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return nil
+			}
+		}
+		specs = append(specs, rangeSpec{Start: start, End: end})
+	}
+	if len(specs) == 0 || len(specs) > maxMultiRanges {
+		return nil
+	}
+	return specs
+}
+
+// resolveRanges 按文件大小计算实际范围：丢弃无法满足的范围，按起点排序后合并重叠或相邻的范围；
+// 返回空列表时应响应 416
+func resolveRanges(specs []rangeSpec, size int64) []byteRange {
+	var ranges []byteRange
+	for _, spec := range specs {
+		var r byteRange
+		if spec.Suffix {
+			if spec.End == 0 || size == 0 {
+				continue
+			}
+			r = byteRange{Start: size - spec.End, End: size - 1}
+			if r.Start < 0 {
+				r.Start = 0
+			}
+		} else {
+			if spec.Start >= size {
+				continue
+			}
+			r = byteRange{Start: spec.Start, End: spec.End}
+			if r.End == -1 || r.End >= size {
+				r.End = size - 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) < 2 {
+		return ranges
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.Start <= last.End+1 {
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func newBoundary() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// countingWriter 只统计写入的字节数，用于提前计算 multipart 响应的 Content-Length
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+func partHeader(contentType string, r byteRange, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {contentType},
+		"Content-Range": {r.contentRange(size)},
+	}
+}
+
+// multipartSize 计算 multipart/byteranges 响应体的总长度
+func multipartSize(boundary string, contentType string, ranges []byteRange, size int64) int64 {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(boundary)
+	for _, r := range ranges {
+		mw.CreatePart(partHeader(contentType, r, size))
+		w += countingWriter(r.length())
+	}
+	mw.Close()
+	return int64(w)
+}
+
+// serveMultiRange 以 multipart/byteranges 响应多个范围，每个范围依次交给多线程下载，
+// 响应头沿用探测得到的头信息，Content-Type 放到各个分段中
+func serveMultiRange(ctx context.Context, w http.ResponseWriter, req *http.Request, cfg *Config, url string,
+	responseHeaders http.Header, ranges []byteRange, contentSize int64, validators fileValidators, splitSize int64, numTasks int64) {
+	log := requestLogger(ctx)
+	contentType := responseHeaders.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	boundary := newBoundary()
+
+	for key, values := range responseHeaders {
+		if isHopByHopHeader(key) {
+			continue
+		}
+		w.Header().Set(key, strings.Join(values, ","))
+	}
+	w.Header().Del("Content-Range")
+	w.Header().Del("Content-Encoding")
+	w.Header().Del("Transfer-Encoding")
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	w.Header().Set("Content-Length", strconv.FormatInt(multipartSize(boundary, contentType, ranges, contentSize), 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Cache-Control", "public, max-age=31536000")
+	w.WriteHeader(http.StatusPartialContent)
+	if req.Method == http.MethodHead {
+		return
+	}
+
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(boundary)
+	buf := make([]byte, 32*1024)
+	for _, r := range ranges {
+		part, err := mw.CreatePart(partHeader(contentType, r, contentSize))
+		if err != nil {
+			return
+		}
+		rp, wp := io.Pipe()
+		emitter := base.NewEmitter(rp, wp)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ConcurrentDownload(ctx, cfg, url, r.Start, r.End, validators, splitSize, numTasks, emitter, req)
+		}()
+		n, err := io.CopyBuffer(part, io.LimitReader(emitter, r.length()), buf)
+		emitter.Close()
+		// 等上一部分的会话结束并注销后再开始下一部分，同一时间只有一个会话
+		<-done
+		if n != r.length() {
+			// 长度已经写在响应头中，无法补救，直接中断连接让客户端重试
+			log.Warnf("多范围响应中 %s 只发送了 %d 字节: %v", r.contentRange(contentSize), n, err)
+			return
+		}
+	}
+	mw.Close()
+}
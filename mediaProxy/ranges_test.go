@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRangeHeader(t *testing.T) {
+	tooMany := "bytes=0-0"
+	for i := 1; i <= maxMultiRanges; i++ {
+		tooMany += ",0-0"
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		want   []rangeSpec
+	}{
+		{"单个范围", "bytes=0-1023", []rangeSpec{{Start: 0, End: 1023}}},
+		{"开放范围", "bytes=100-", []rangeSpec{{Start: 100, End: -1}}},
+		{"后缀范围", "bytes=-500", []rangeSpec{{End: 500, Suffix: true}}},
+		{"多个范围", "bytes=0-99, 200-299,-10", []rangeSpec{{Start: 0, End: 99}, {Start: 200, End: 299}, {End: 10, Suffix: true}}},
+		{"空白和空项", "  bytes= 0 - 9 ,, ", []rangeSpec{{Start: 0, End: 9}}},
+		{"单位不是 bytes", "items=0-9", nil},
+		{"缺少连字符", "bytes=100", nil},
+		{"终点小于起点", "bytes=10-5", nil},
+		{"非数字", "bytes=a-b", nil},
+		{"负数起点", "bytes=--5", nil},
+		{"没有范围", "bytes=", nil},
+		{"范围过多", tooMany, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRangeHeader(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRangeHeader(%q) = %+v, want %+v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveRanges(t *testing.T) {
+	tests := []struct {
+		name  string
+		specs []rangeSpec
+		size  int64
+		want  []byteRange
+	}{
+		{"普通范围", []rangeSpec{{Start: 0, End: 99}}, 1000, []byteRange{{0, 99}}},
+		{"终点超出文件大小", []rangeSpec{{Start: 900, End: 5000}}, 1000, []byteRange{{900, 999}}},
+		{"开放范围", []rangeSpec{{Start: 500, End: -1}}, 1000, []byteRange{{500, 999}}},
+		{"后缀范围", []rangeSpec{{End: 100, Suffix: true}}, 1000, []byteRange{{900, 999}}},
+		{"后缀范围大于文件", []rangeSpec{{End: 5000, Suffix: true}}, 1000, []byteRange{{0, 999}}},
+		{"合并重叠范围", []rangeSpec{{Start: 0, End: 199}, {Start: 100, End: 299}}, 1000, []byteRange{{0, 299}}},
+		{"合并相邻范围", []rangeSpec{{Start: 0, End: 99}, {Start: 100, End: 199}}, 1000, []byteRange{{0, 199}}},
+		{"乱序后排序", []rangeSpec{{Start: 500, End: 599}, {Start: 0, End: 99}}, 1000, []byteRange{{0, 99}, {500, 599}}},
+		{"包含的范围", []rangeSpec{{Start: 0, End: 999}, {Start: 10, End: 20}}, 1000, []byteRange{{0, 999}}},
+		{"丢弃无法满足的范围", []rangeSpec{{Start: 2000, End: 2100}, {Start: 0, End: 9}}, 1000, []byteRange{{0, 9}}},
+		{"全部超出返回空 (416)", []rangeSpec{{Start: 1000, End: -1}, {Start: 5000, End: 6000}}, 1000, nil},
+		{"后缀长度为 0 (416)", []rangeSpec{{End: 0, Suffix: true}}, 1000, nil},
+		{"空文件 (416)", []rangeSpec{{End: 10, Suffix: true}, {Start: 0, End: -1}}, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveRanges(tt.specs, tt.size); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveRanges(%+v, %d) = %+v, want %+v", tt.specs, tt.size, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	handleUrl "net/url"
+	"strings"
+	"time"
+
+	"MediaProxy/base"
+)
+
+// maxRedirects 解析重定向链时最多跟随的次数，与 checkRedirect 的限制相同
+const maxRedirects = 10
+
+// resolvedURL 重定向链的终点以及重定向过程中拿到的、适用于终点的 Cookie
+type resolvedURL struct {
+	URL     string
+	Cookies []*http.Cookie
+}
+
+// credentialHeaderNames 客户端发给原始地址的凭据头，重定向到其他主机（如 CDN）后不再转发，与 net/http 自动跟随重定向时的处理一致
+var credentialHeaderNames = []string{"Authorization", "Proxy-Authorization", "Cookie", "Cookie2"}
+
+// headerForHost 返回请求 target 时使用的请求头：与 origin 不是同一主机时去掉凭据头，header 本身不修改
+func headerForHost(header map[string][]string, origin string, target string) map[string][]string {
+	if sameHost(origin, target) {
+		return header
+	}
+	stripped := make(map[string][]string, len(header))
+	for name, value := range header {
+		stripped[name] = value
+	}
+	for _, name := range credentialHeaderNames {
+		delete(stripped, name)
+	}
+	return stripped
+}
+
+// sameHost 比较两个地址的主机名，解析失败时按不同主机处理
+func sameHost(a string, b string) bool {
+	ua, err := handleUrl.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := handleUrl.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Hostname(), ub.Hostname())
+}
+
+// redirectKey 重定向终点和 Cookie 按 upstreamScope 缓存，只给带着相同请求头的请求使用
+func redirectKey(scope string) string {
+	return scope + "#Redirect"
+}
+
+// cachedRedirect 返回探测时在同一作用域下解析出的终点，没有重定向或已失效时返回 false
+func cachedRedirect(scope string) (resolvedURL, bool) {
+	if v, found := mediaCache.Get(redirectKey(scope)); found {
+		return v.(resolvedURL), true
+	}
+	return resolvedURL{}, false
+}
+
+// resolveRedirects 用不跟随重定向的客户端逐跳请求，得到网盘签名链接 302 之后的 CDN 地址。
+// 分片请求直接访问终点，避免每个分片都重新经过一次重定向（请求数翻倍，且容易触发重定向服务的频率限制）。
+// 每一跳设置的 Cookie 写入 jar，没有重定向时返回原地址；跳到其他主机后不再带客户端的凭据头
+func resolveRedirects(ctx context.Context, cfg *Config, url string, header map[string][]string, jar *cookiejar.Jar) (resolvedURL, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	current := url
+	for i := 0; i <= maxRedirects; i++ {
+		u, err := handleUrl.Parse(current)
+		if err != nil {
+			return resolvedURL{}, err
+		}
+		if err := cfg.clients.CheckContextHost(ctx, u.Hostname()); err != nil {
+			return resolvedURL{}, err
+		}
+		lease, err := hostLimits.acquire(ctx, cfg, current, false)
+		if err != nil {
+			return resolvedURL{}, err
+		}
+		// 只请求一个字节，终点的响应会被丢弃
+		resp, err := cfg.clients.NoRedirectClient.R().
+			SetContext(withClientTrace(ctx)).
+			SetDoNotParseResponse(true).
+			SetHeaderMultiValues(headerForHost(header, url, current)).
+			SetHeader("Range", "bytes=0-0").
+			SetCookies(jar.Cookies(u)).
+			Get(current)
+		if err != nil {
+			lease.done(0, err)
+			return resolvedURL{}, err
+		}
+		lease.done(resp.StatusCode(), nil)
+		resp.RawBody().Close()
+		jar.SetCookies(u, resp.Cookies())
+
+		location := resp.Header().Get("Location")
+		if resp.StatusCode() < 300 || resp.StatusCode() >= 400 || location == "" {
+			return resolvedURL{URL: current, Cookies: jar.Cookies(u)}, nil
+		}
+		next, err := u.Parse(location)
+		if err != nil {
+			return resolvedURL{}, fmt.Errorf("无效的重定向地址 %q: %w", location, err)
+		}
+		requestLogger(ctx).Debugf("%v 重定向到 %v (statusCode: %d)", redactURL(current), redactURL(next.String()), resp.StatusCode())
+		current = next.String()
+	}
+	return resolvedURL{}, fmt.Errorf("重定向次数过多")
+}
+
+// resolveAndProbe 解析 source 的重定向链并探测终点；终点返回过期类状态码时回到 source 重新探测，由客户端自动跟随重定向。
+// 返回的 target 是之后分片请求应访问的地址
+func resolveAndProbe(ctx context.Context, cfg *Config, source string, header map[string][]string, jar *cookiejar.Jar) (target string, resolved resolvedURL, probe *probeResult, err error) {
+	log := requestLogger(ctx)
+	target = source
+	resolved, err = resolveRedirects(ctx, cfg, source, header, jar)
+	var open *circuitOpenError
+	if errors.Is(err, base.ErrDestinationBlocked) || errors.As(err, &open) {
+		return
+	}
+	if err == nil {
+		target = resolved.URL
+	} else {
+		log.Warnf("解析 %v 的重定向失败，使用原地址: %v", redactURL(source), redactError(err))
+	}
+
+	// 依次尝试各探测方式获取头信息
+	probe, err = probeUpstream(ctx, cfg, target, headerForHost(header, source, target), jar)
+	if err == nil && target != source && isExpiredStatus(probe.Resp.StatusCode()) {
+		log.Debugf("重定向终点 %v 返回 %d，改用原地址", redactURL(target), probe.Resp.StatusCode())
+		probe.Resp.RawBody().Close()
+		target = source
+		probe, err = probeUpstream(ctx, cfg, target, header, jar)
+	}
+	return
+}
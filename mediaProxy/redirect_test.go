@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHeaderForHost(t *testing.T) {
+	header := map[string][]string{
+		"Authorization": {"Basic dXNlcjpwdw=="},
+		"Cookie":        {"sess=1"},
+		"Referer":       {"https://pan.example.com/"},
+	}
+	stripped := map[string][]string{"Referer": {"https://pan.example.com/"}}
+
+	tests := []struct {
+		name   string
+		origin string
+		target string
+		want   map[string][]string
+	}{
+		{"同一地址", "https://pan.example.com/f", "https://pan.example.com/f", header},
+		{"同一主机不同路径和端口", "https://pan.example.com/f", "http://PAN.example.com:8080/cdn/f", header},
+		{"重定向到 CDN", "https://pan.example.com/f", "https://cdn.example.net/f?sig=1", stripped},
+		{"重定向到子域名", "https://example.com/f", "https://cdn.example.com/f", stripped},
+		{"IP 地址不同", "http://127.0.0.1:9000/f", "http://localhost:9000/f", stripped},
+		{"无法解析的地址", "https://pan.example.com/f", "http://[::1/f", stripped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := headerForHost(header, tt.origin, tt.target); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("headerForHost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if len(header) != 3 {
+		t.Errorf("headerForHost() 修改了传入的请求头: %v", header)
+	}
+}
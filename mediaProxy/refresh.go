@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	handleUrl "net/url"
+	"strings"
+	"time"
+)
+
+// minRefreshInterval 两次刷新之间的最小间隔，刷新得到的链接仍然失效时不再反复请求回调
+const minRefreshInterval = 10 * time.Second
+
+// refreshedLink 刷新回调返回的新直链及其需要的请求头
+type refreshedLink struct {
+	URL    string
+	Header map[string]string
+}
+
+// refreshScope 在 upstreamScope 的基础上区分密钥和 refresh 回调。带回调的请求可能改用刷新后的直链，
+// 刷新得到的直链以及之后探测到的头信息、重定向终点只给同一密钥、带着同一个回调的请求使用，
+// 其他客户端不能通过自己的回调替换别人播放的内容，也不会被带到别人刷新后的地址
+func refreshScope(ctx context.Context, scope string, refreshURL string) string {
+	if refreshURL == "" {
+		return scope
+	}
+	var keyLabel string
+	if info := getRequestInfo(ctx); info != nil {
+		keyLabel = info.KeyLabel
+	}
+	return scope + "#Refresh#" + keyLabel + "#" + refreshURL
+}
+
+// refreshKey 刷新得到的直链按 refreshScope 缓存
+func refreshKey(scope string) string {
+	return scope + "#Refreshed"
+}
+
+// cachedRefresh 返回之前刷新得到的直链，播放器拖动时仍使用旧地址请求，需要继续使用新直链；没有 refresh 回调时返回 false
+func cachedRefresh(scope string, refreshURL string) (refreshedLink, bool) {
+	if refreshURL == "" {
+		return refreshedLink{}, false
+	}
+	if v, found := mediaCache.Get(refreshKey(scope)); found {
+		return v.(refreshedLink), true
+	}
+	return refreshedLink{}, false
+}
+
+// isExpiredStatus 签名链接过期时上游常见的状态码
+func isExpiredStatus(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden || statusCode == http.StatusGone
+}
+
+// refreshParam 取出请求中的 refresh 回调地址，form=base64 时与 url 参数一样按 Base64 解码
+func refreshParam(req *http.Request) string {
+	query := req.URL.Query()
+	refresh := query.Get("refresh")
+	if refresh != "" && query.Get("form") == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(refresh)
+		if err != nil {
+			return ""
+		}
+		refresh = string(decoded)
+	}
+	return refresh
+}
+
+// applyLinkHeader 把新直链需要的请求头合并到上游请求头中
+func applyLinkHeader(header map[string][]string, linkHeader map[string]string) {
+	for name, value := range linkHeader {
+		if !shouldFilterHeaderName(name) {
+			header[http.CanonicalHeaderKey(name)] = []string{value}
+		}
+	}
+}
+
+// callRefresh 请求刷新回调获取新的直链。回调返回 JSON 时读取 url 和 header(s) 字段（兼容 drpyS 等解析接口），
+// 否则把响应体整体作为新地址
+func callRefresh(ctx context.Context, cfg *Config, refreshURL string, url string, scope string) (refreshedLink, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	resp, err := cfg.clients.NewRestyClient().R().
+		SetContext(withClientTrace(ctx)).
+		Get(refreshURL)
+	if err != nil {
+		return refreshedLink{}, err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return refreshedLink{}, fmt.Errorf("刷新回调返回 statusCode: %d", resp.StatusCode())
+	}
+
+	body := strings.TrimSpace(resp.String())
+	var link refreshedLink
+	if strings.HasPrefix(body, "{") {
+		var result struct {
+			URL     string            `json:"url"`
+			Header  map[string]string `json:"header"`
+			Headers map[string]string `json:"headers"`
+		}
+		if err := json.Unmarshal([]byte(body), &result); err != nil {
+			return refreshedLink{}, fmt.Errorf("无法解析刷新回调的响应: %w", err)
+		}
+		link = refreshedLink{URL: result.URL, Header: result.Headers}
+		if link.Header == nil {
+			link.Header = result.Header
+		}
+	} else {
+		link.URL = body
+	}
+	u, err := handleUrl.Parse(link.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return refreshedLink{}, fmt.Errorf("刷新回调返回的地址无效: %q", link.URL)
+	}
+	// 新直链与 url 一样受目标地址策略和密钥 allowed_domains 的限制
+	if err := cfg.clients.CheckContextHost(ctx, u.Hostname()); err != nil {
+		return refreshedLink{}, err
+	}
+	requestLogger(ctx).Infof("%v 的直链已刷新为 %v", redactURL(url), redactURL(link.URL))
+	mediaCache.Set(refreshKey(scope), link, 1800*time.Second)
+	mediaCache.Delete(redirectKey(scope))
+	return link, nil
+}
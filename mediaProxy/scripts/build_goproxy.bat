@@ -8,7 +8,7 @@ set CGO_ENABLED=0
 set GOOS=linux
 set GOARCH=arm
 set GOARM=7
-go build -trimpath -ldflags="-w -s" -o goProxy/goProxy-arm proxy.go
+go build -trimpath -ldflags="-w -s" -o goProxy/goProxy-arm .
 if %errorlevel% neq 0 (
     echo Failed to build goProxy-arm
     exit /b %errorlevel%
@@ -25,7 +25,7 @@ echo [2/2] Building Android 64-bit (ARM64)...
 set CGO_ENABLED=0
 set GOOS=linux
 set GOARCH=arm64
-go build -trimpath -ldflags="-w -s" -o goProxy/goProxy-arm64 proxy.go
+go build -trimpath -ldflags="-w -s" -o goProxy/goProxy-arm64 .
 if %errorlevel% neq 0 (
     echo Failed to build goProxy-arm64
     exit /b %errorlevel%
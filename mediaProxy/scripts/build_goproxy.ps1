@@ -5,7 +5,7 @@ $env:CGO_ENABLED="0"
 $env:GOOS="linux"
 $env:GOARCH="arm"
 $env:GOARM="7"
-go build -trimpath -ldflags="-w -s" -o goProxy/goProxy-arm proxy.go
+go build -trimpath -ldflags="-w -s" -o goProxy/goProxy-arm .
 if ($LASTEXITCODE -ne 0) {
     Write-Error "Failed to build goProxy-arm"
     exit $LASTEXITCODE
@@ -22,7 +22,7 @@ Write-Host "[2/2] Building Android 64-bit (ARM64)..."
 $env:CGO_ENABLED="0"
 $env:GOOS="linux"
 $env:GOARCH="arm64"
-go build -trimpath -ldflags="-w -s" -o goProxy/goProxy-arm64 proxy.go
+go build -trimpath -ldflags="-w -s" -o goProxy/goProxy-arm64 .
 if ($LASTEXITCODE -ne 0) {
     Write-Error "Failed to build goProxy-arm64"
     exit $LASTEXITCODE
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ServerOptions 监听相关的配置
+type ServerOptions struct {
+	Port       string
+	TLSPort    string // 不为空时在该端口额外提供 HTTPS，否则 HTTPS 替代 Port 上的 HTTP
+	CertFile   string
+	KeyFile    string
+	SelfSigned bool // 自动生成自签名证书
+	H2C        bool // 明文 HTTP 端口支持 h2c
+}
+
+func (o ServerOptions) tlsEnabled() bool {
+	return o.SelfSigned || (o.CertFile != "" && o.KeyFile != "")
+}
+
+// newRouter 管理接口使用独立的路由，其余请求都交给 handleMethod
+func newRouter() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/sessions", adminAuth(handleListSessions))
+	mux.HandleFunc("DELETE /api/sessions/{id}", adminAuth(handleKillSession))
+	mux.HandleFunc("GET /metrics", metricsAuth(metricsHandler().ServeHTTP))
+	mux.HandleFunc("GET /api/events", adminAuth(handleDashboardEvents))
+	mux.HandleFunc("GET /api/sign", adminAuth(handleSignURL))
+	mux.HandleFunc("GET /api/keys", adminAuth(handleListKeys))
+	mux.HandleFunc("PUT /api/keys/{label}", adminAuth(handlePutKey))
+	mux.HandleFunc("DELETE /api/keys/{label}", adminAuth(handleDeleteKey))
+	mux.HandleFunc("/", handleMethod)
+	return withRequestLog(withClientACL(mux))
+}
+
+// runServer 根据配置启动 HTTP / HTTPS 监听，任意一个监听退出时返回
+func runServer(handler http.Handler, opts ServerOptions) error {
+	var tlsConfig *tls.Config
+	if opts.tlsEnabled() {
+		cert, err := loadServerCertificate(opts)
+		if err != nil {
+			return err
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	plainHandler := handler
+	if opts.H2C {
+		plainHandler = h2c.NewHandler(handler, &http2.Server{})
+	}
+
+	errChan := make(chan error, 2)
+	if tlsConfig == nil || opts.TLSPort != "" {
+		server := &http.Server{
+			Addr:    ":" + opts.Port,
+			Handler: plainHandler,
+		}
+		logrus.Infof("HTTP 服务运行在 %s 端口 (h2c: %v).", opts.Port, opts.H2C)
+		go func() { errChan <- server.ListenAndServe() }()
+	}
+	if tlsConfig != nil {
+		port := opts.TLSPort
+		if port == "" {
+			port = opts.Port
+		}
+		server := &http.Server{
+			Addr:      ":" + port,
+			Handler:   handler,
+			TLSConfig: tlsConfig,
+		}
+		// 显式配置 HTTP/2，ALPN 协商失败时自动使用 HTTP/1.1
+		if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+			return err
+		}
+		logrus.Infof("HTTPS 服务运行在 %s 端口 (h2: true).", port)
+		go func() { errChan <- server.ListenAndServeTLS("", "") }()
+	}
+	return <-errChan
+}
+
+// loadServerCertificate 加载证书；自签名模式下，如果指定的证书文件不存在则生成并写入，便于下次复用
+func loadServerCertificate(opts ServerOptions) (tls.Certificate, error) {
+	if opts.CertFile != "" && opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err == nil || !opts.SelfSigned || !errors.Is(err, os.ErrNotExist) {
+			return cert, err
+		}
+	}
+
+	certPEM, keyPEM, err := generateSelfSignedCert()
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("生成自签名证书失败: %v", err)
+	}
+	if opts.CertFile != "" && opts.KeyFile != "" {
+		if err := os.WriteFile(opts.CertFile, certPEM, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(opts.KeyFile, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+		logrus.Infof("已生成自签名证书: %s", opts.CertFile)
+	} else {
+		logrus.Info("已生成临时自签名证书，重启后会变化")
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// generateSelfSignedCert 生成覆盖 localhost 和本机所有地址的自签名证书
+func generateSelfSignedCert() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "mediaProxy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	handleUrl "net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"MediaProxy/base"
+)
+
+// Session 记录一个 ConcurrentDownload 会话的运行状态
+type Session struct {
+	ID         string // 服务端生成，唯一
+	RequestID  string // 发起会话的请求 ID，用于和日志对应
+	URL        string // 已脱敏的上游地址
+	ClientAddr string
+	Key        string // 使用的密钥 label，主密钥或未开启认证时为空
+	RangeStart int64
+	RangeEnd   int64
+	StartTime  time.Time
+
+	bytesDelivered atomic.Int64
+	speed          atomic.Int64 // 最近一秒的速度(字节/秒)
+	lastBytes      int64        // 仅由采样协程访问
+
+	p       *ProxyDownloadStruct
+	emitter *base.Emitter
+}
+
+// SessionInfo 会话信息的快照，用于 API 输出
+type SessionInfo struct {
+	ID             string    `json:"id"`
+	RequestID      string    `json:"request_id,omitempty"`
+	URL            string    `json:"url"`
+	ClientAddr     string    `json:"client"`
+	Key            string    `json:"key,omitempty"`
+	RangeStart     int64     `json:"range_start"`
+	RangeEnd       int64     `json:"range_end"`
+	BytesDelivered int64     `json:"bytes_delivered"`
+	Speed          int64     `json:"speed"`
+	Workers        int64     `json:"workers"`
+	Threads        int64     `json:"threads"`
+	BufferedChunks int       `json:"buffered_chunks"`
+	StartTime      time.Time `json:"start_time"`
+	Duration       float64   `json:"duration"`
+}
+
+func (s *Session) addDelivered(n int) {
+	s.bytesDelivered.Add(int64(n))
+}
+
+func (s *Session) Info() SessionInfo {
+	return SessionInfo{
+		ID:             s.ID,
+		RequestID:      s.RequestID,
+		URL:            s.URL,
+		ClientAddr:     s.ClientAddr,
+		Key:            s.Key,
+		RangeStart:     s.RangeStart,
+		RangeEnd:       s.RangeEnd,
+		BytesDelivered: s.bytesDelivered.Load(),
+		Speed:          s.speed.Load(),
+		Workers:        s.p.ActiveWorkers.Load(),
+		Threads:        s.p.ThreadCount,
+		BufferedChunks: int(s.p.BufferedChunks.Load()),
+		StartTime:      s.StartTime,
+		Duration:       time.Since(s.StartTime).Seconds(),
+	}
+}
+
+// SessionRegistry 进程内所有活跃会话
+type SessionRegistry struct {
+	mutex    sync.RWMutex
+	sessions map[string]*Session
+}
+
+var sessions = newSessionRegistry()
+
+func newSessionRegistry() *SessionRegistry {
+	r := &SessionRegistry{sessions: make(map[string]*Session)}
+	go r.sampleSpeed()
+	return r
+}
+
+// Register 登记会话。会话 ID 由服务端生成：请求 ID 可以由客户端通过 X-Request-ID 指定，
+// 不能作为会话的唯一标识，只记录在 RequestID 中方便和日志对应
+func (r *SessionRegistry) Register(ctx context.Context, p *ProxyDownloadStruct, emitter *base.Emitter, downloadUrl string, clientAddr string) *Session {
+	var requestID, keyLabel string
+	if info := getRequestInfo(ctx); info != nil {
+		requestID = info.ID
+		keyLabel = info.KeyLabel
+	}
+	s := &Session{
+		RequestID:  requestID,
+		URL:        redactURL(downloadUrl),
+		ClientAddr: clientAddr,
+		Key:        keyLabel,
+		RangeStart: p.startOffset,
+		RangeEnd:   p.EndOffset,
+		StartTime:  time.Now(),
+		p:          p,
+		emitter:    emitter,
+	}
+	r.mutex.Lock()
+	for {
+		s.ID = newRequestID()
+		if _, exists := r.sessions[s.ID]; !exists {
+			break
+		}
+	}
+	r.sessions[s.ID] = s
+	r.mutex.Unlock()
+	return s
+}
+
+func (r *SessionRegistry) Unregister(s *Session) {
+	r.mutex.Lock()
+	if r.sessions[s.ID] == s {
+		delete(r.sessions, s.ID)
+	}
+	r.mutex.Unlock()
+}
+
+func (r *SessionRegistry) Get(id string) *Session {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.sessions[id]
+}
+
+// List 返回按开始时间排序的会话快照
+func (r *SessionRegistry) List() []SessionInfo {
+	r.mutex.RLock()
+	infos := make([]SessionInfo, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		infos = append(infos, s.Info())
+	}
+	r.mutex.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartTime.Before(infos[j].StartTime)
+	})
+	return infos
+}
+
+// BufferedBytes 所有会话中已下载但尚未发送给客户端的数据量
+func (r *SessionRegistry) BufferedBytes() int64 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var total int64
+	for _, s := range r.sessions {
+		total += s.p.BufferedBytes.Load()
+	}
+	return total
+}
+
+func (r *SessionRegistry) Count() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.sessions)
+}
+
+// Kill 停止指定会话：取消会话的 ctx，由会话自己的协程停止下载；关闭 emitter 使阻塞在写入上的会话也能立即结束，
+// 播放器侧的连接随之断开。不在管理接口的协程中调用 ProxyStop，ProxyRunning 不是并发安全的
+func (r *SessionRegistry) Kill(id string) bool {
+	s := r.Get(id)
+	if s == nil {
+		return false
+	}
+	s.p.Cancel()
+	s.emitter.Close()
+	return true
+}
+
+// sampleSpeed 每秒采样一次各会话的交付字节数，计算当前速度
+func (r *SessionRegistry) sampleSpeed() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.mutex.RLock()
+		for _, s := range r.sessions {
+			total := s.bytesDelivered.Load()
+			s.speed.Store(total - s.lastBytes)
+			s.lastBytes = total
+		}
+		r.mutex.RUnlock()
+	}
+}
+
+// redactURL 去掉地址中的用户信息并隐藏查询参数的值，避免签名和 token 出现在日志和 API 中
+func redactURL(rawUrl string) string {
+	u, err := handleUrl.Parse(rawUrl)
+	if err != nil {
+		return "(invalid url)"
+	}
+	u.User = nil
+	u.Fragment = ""
+	if u.RawQuery != "" {
+		query := u.Query()
+		keys := make([]string, 0, len(query))
+		for key := range query {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		redacted := ""
+		for i, key := range keys {
+			if i > 0 {
+				redacted += "&"
+			}
+			redacted += handleUrl.QueryEscape(key) + "=***"
+		}
+		u.RawQuery = redacted
+	}
+	return u.String()
+}
+
+// redactError 返回错误信息，其中 url.Error 带上的完整请求地址按 redactURL 脱敏
+func redactError(err error) string {
+	msg := err.Error()
+	var ue *handleUrl.Error
+	if errors.As(err, &ue) && ue.URL != "" {
+		msg = strings.ReplaceAll(msg, ue.URL, redactURL(ue.URL))
+	}
+	return msg
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	handleUrl "net/url"
+	"testing"
+)
+
+func TestRedactURL(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"没有查询参数", "https://cdn.example.com/v.mp4", "https://cdn.example.com/v.mp4"},
+		{"隐藏查询参数的值", "https://cdn.example.com/v.mp4?token=abc&exp=1", "https://cdn.example.com/v.mp4?exp=***&token=***"},
+		{"去掉用户信息和片段", "https://user:pw@cdn.example.com/v.mp4#t=10", "https://cdn.example.com/v.mp4"},
+		{"无效地址", "http://[::1/v.mp4", "(invalid url)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactURL(tt.url); got != tt.want {
+				t.Errorf("redactURL(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	const url = "https://cdn.example.com/v.mp4?token=abc"
+	urlErr := &handleUrl.Error{Op: "Get", URL: url, Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"普通错误", errors.New("statusCode: 403"), "statusCode: 403"},
+		{"url.Error", urlErr, `Get "https://cdn.example.com/v.mp4?token=***": connection refused`},
+		{"包装后的 url.Error", fmt.Errorf("探测失败: %w", urlErr), `探测失败: Get "https://cdn.example.com/v.mp4?token=***": connection refused`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactError(tt.err); got != tt.want {
+				t.Errorf("redactError() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
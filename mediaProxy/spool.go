@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errSpoolTooLarge 上游未声明大小且实际数据超过 spool-max-size
+var errSpoolTooLarge = errors.New("超过 spool-max-size")
+
+// errSpoolFull 落盘文件合计超过 spool-total-size，且没有可以清理的空闲文件
+var errSpoolFull = errors.New("落盘文件合计超过 spool-total-size")
+
+// spool 不支持 Range 的上游响应在后台完整下载到临时文件，下载过程中就可以按已下载的部分响应 Range 请求
+type spool struct {
+	Scope   string // 见 upstreamScope
+	URL     string
+	Path    string
+	Headers http.Header // 探测得到的响应头
+	Total   int64       // 上游声明的总大小，-1 表示未知
+
+	file   *os.File
+	cancel context.CancelFunc
+
+	mutex      sync.Mutex
+	written    int64
+	done       bool
+	err        error
+	changed    chan struct{} // 每次写入后关闭并替换，用于唤醒等待数据的读取方
+	refs       int
+	lastAccess time.Time
+}
+
+// spoolStore 按 upstreamScope 保存正在下载或已下载完的落盘文件：落盘内容是用请求方的请求头和 Cookie 下载的，
+// 只给带着相同请求头的请求使用
+type spoolStore struct {
+	mutex  sync.Mutex
+	spools map[string]*spool
+	once   sync.Once
+}
+
+var spools = &spoolStore{spools: make(map[string]*spool)}
+
+// acquire 返回 scope 对应的落盘文件并增加引用，不存在或下载失败时返回 nil
+func (s *spoolStore) acquire(scope string) *spool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sp := s.spools[scope]
+	if sp == nil {
+		return nil
+	}
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	if sp.err != nil {
+		return nil
+	}
+	sp.refs++
+	return sp
+}
+
+// start 创建落盘文件并在后台下载，下载不受发起请求的客户端断开影响（只保留 ctx 中密钥的域名限制等信息），直到空闲超时被清理
+func (s *spoolStore) start(ctx context.Context, cfg *Config, scope string, url string, header http.Header, jar *cookiejar.Jar, headers http.Header, total int64) (*spool, error) {
+	s.once.Do(func() { go s.janitor() })
+	if cfg.SpoolTotalSize > 0 && !s.makeRoom(cfg.SpoolTotalSize, total) {
+		return nil, errSpoolFull
+	}
+	if err := os.MkdirAll(cfg.SpoolDir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(cfg.SpoolDir, "spool-*")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	sp := &spool{
+		Scope:      scope,
+		URL:        url,
+		Path:       file.Name(),
+		Headers:    headers,
+		Total:      total,
+		file:       file,
+		cancel:     cancel,
+		changed:    make(chan struct{}),
+		refs:       1,
+		lastAccess: time.Now(),
+	}
+
+	s.mutex.Lock()
+	if old := s.spools[scope]; old != nil {
+		// 并发请求同时创建时保留先创建的；已有的下载失败时等它被清理，这段时间内直接转发
+		s.mutex.Unlock()
+		sp.remove()
+		if existing := s.acquire(scope); existing != nil {
+			return existing, nil
+		}
+		return nil, fmt.Errorf("上一次落盘下载失败")
+	}
+	s.spools[scope] = sp
+	s.mutex.Unlock()
+
+	go sp.download(ctx, cfg, header, jar)
+	return sp, nil
+}
+
+// release 减少引用，空闲时间从最后一次释放开始计算
+func (sp *spool) release() {
+	sp.mutex.Lock()
+	sp.refs--
+	sp.lastAccess = time.Now()
+	sp.mutex.Unlock()
+}
+
+func (sp *spool) remove() {
+	sp.cancel()
+	sp.file.Close()
+	os.Remove(sp.Path)
+}
+
+// janitor 定期清理空闲超过 spool-ttl 的落盘文件，下载失败的在空闲后立即清理
+func (s *spoolStore) janitor() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.evict(time.Duration(getConfig().SpoolTTL) * time.Second)
+	}
+}
+
+func (s *spoolStore) evict(ttl time.Duration) {
+	s.mutex.Lock()
+	var expired []*spool
+	for url, sp := range s.spools {
+		sp.mutex.Lock()
+		idle := sp.refs <= 0 && (sp.err != nil || time.Since(sp.lastAccess) > ttl)
+		sp.mutex.Unlock()
+		if idle {
+			delete(s.spools, url)
+			expired = append(expired, sp)
+		}
+	}
+	s.mutex.Unlock()
+	for _, sp := range expired {
+		sp.remove()
+		logrus.Debugf("落盘文件 %s (%v) 空闲超时，已删除", sp.Path, redactURL(sp.URL))
+	}
+}
+
+// size 落盘文件占用的空间，上游声明了大小时按声明的大小预留
+func (sp *spool) size() int64 {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	if sp.Total > sp.written {
+		return sp.Total
+	}
+	return sp.written
+}
+
+// usedBytes 全部落盘文件占用的空间
+func (s *spoolStore) usedBytes() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var used int64
+	for _, sp := range s.spools {
+		used += sp.size()
+	}
+	return used
+}
+
+// makeRoom 为大小为 need（未知时为 -1）的新落盘文件腾出空间：合计超过 limit 时按最后访问时间从旧到新删除空闲的文件，
+// 仍然不够时返回 false
+func (s *spoolStore) makeRoom(limit int64, need int64) bool {
+	if need < 0 {
+		need = 0
+	}
+	// lastAccess 和大小在各自的锁内取一次快照，排序和扣减都使用快照
+	type idleSpool struct {
+		sp         *spool
+		size       int64
+		lastAccess time.Time
+	}
+	s.mutex.Lock()
+	var used int64
+	var idle []idleSpool
+	for _, sp := range s.spools {
+		size := sp.size()
+		used += size
+		sp.mutex.Lock()
+		if sp.refs <= 0 {
+			idle = append(idle, idleSpool{sp: sp, size: size, lastAccess: sp.lastAccess})
+		}
+		sp.mutex.Unlock()
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].lastAccess.Before(idle[j].lastAccess) })
+	var evicted []*spool
+	for _, item := range idle {
+		if used+need <= limit {
+			break
+		}
+		delete(s.spools, item.sp.Scope)
+		used -= item.size
+		evicted = append(evicted, item.sp)
+	}
+	s.mutex.Unlock()
+	for _, sp := range evicted {
+		sp.remove()
+		logrus.Debugf("落盘文件合计超过 spool-total-size，删除最久未使用的 %s (%v)", sp.Path, redactURL(sp.URL))
+	}
+	return used+need <= limit
+}
+
+// Close 删除全部落盘文件，退出时调用
+func (s *spoolStore) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for url, sp := range s.spools {
+		delete(s.spools, url)
+		sp.remove()
+	}
+}
+
+func (sp *spool) download(ctx context.Context, cfg *Config, header http.Header, jar *cookiejar.Jar) {
+	err := sp.fetch(ctx, cfg, header, jar)
+	sp.mutex.Lock()
+	sp.done = true
+	sp.err = err
+	if err == nil {
+		sp.Total = sp.written
+	}
+	close(sp.changed)
+	sp.changed = make(chan struct{})
+	sp.mutex.Unlock()
+	if err != nil && !errors.Is(err, context.Canceled) {
+		logrus.Warnf("落盘下载 %v 在 %d 字节处结束: %v", redactURL(sp.URL), sp.written, redactError(err))
+	}
+}
+
+func (sp *spool) fetch(ctx context.Context, cfg *Config, header http.Header, jar *cookiejar.Jar) error {
+	upstreamReq, err := http.NewRequestWithContext(ctx, http.MethodGet, sp.URL, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		upstreamReq.Header[name] = values
+	}
+	upstreamReq.Header.Del("Range")
+	client := cfg.clients.NewHttpClient()
+	client.Jar = jar
+	resp, err := hostLimits.do(ctx, cfg, client, upstreamReq, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("statusCode: %d", resp.StatusCode)
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			if cfg.SpoolMaxSize > 0 && sp.written+int64(n) > cfg.SpoolMaxSize {
+				return errSpoolTooLarge
+			}
+			if cfg.SpoolTotalSize > 0 && sp.Total < 0 && spools.usedBytes()+int64(n) > cfg.SpoolTotalSize {
+				// 上游未声明大小时无法预留空间，下载过程中检查合计大小
+				return errSpoolFull
+			}
+			if _, err := sp.file.WriteAt(buf[:n], sp.written); err != nil {
+				return err
+			}
+			metricBytesIn.Add(float64(n))
+			sp.mutex.Lock()
+			sp.written += int64(n)
+			close(sp.changed)
+			sp.changed = make(chan struct{})
+			sp.mutex.Unlock()
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// state 返回已下载的大小、总大小（未知时 -1）、是否结束以及用于等待新数据的通道
+func (sp *spool) state() (written int64, total int64, done bool, changed chan struct{}) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	return sp.written, sp.Total, sp.done, sp.changed
+}
+
+// waitFor 等待数据下载到 offset 之后，返回当前可读的结束位置；下载已结束且没有更多数据时返回 offset
+func (sp *spool) waitFor(ctx context.Context, offset int64) (int64, error) {
+	for {
+		written, _, done, changed := sp.state()
+		if written > offset || done {
+			return written, nil
+		}
+		select {
+		case <-ctx.Done():
+			return offset, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// waitTotal 等待总大小确定（上游未声明 Content-Length 时需要下载完成）
+func (sp *spool) waitTotal(ctx context.Context) (int64, error) {
+	for {
+		_, total, done, changed := sp.state()
+		if total >= 0 || done {
+			return total, nil
+		}
+		select {
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// serveSpool 从落盘文件响应请求，支持单个 Range；请求的位置尚未下载到时等待下载进度
+func serveSpool(ctx context.Context, w http.ResponseWriter, req *http.Request, sp *spool, conds conditions) {
+	defer sp.release()
+	log := requestLogger(ctx)
+	requestRange := req.Header.Get("Range")
+
+	done, ignoreRange := conds.apply(w, req.Method, requestRange != "", sp.Headers)
+	if done {
+		return
+	}
+	var specs []rangeSpec
+	if !ignoreRange {
+		specs = parseRangeHeader(requestRange)
+	}
+
+	start, end := int64(0), int64(-1)
+	statusCode := http.StatusOK
+	_, total, _, _ := sp.state()
+	if len(specs) == 1 {
+		// 后缀范围或总大小未知时，需要等到下载完成才能确定范围
+		if total < 0 {
+			var err error
+			if total, err = sp.waitTotal(ctx); err != nil {
+				return
+			}
+		}
+		if total >= 0 {
+			ranges := resolveRanges(specs, total)
+			if len(ranges) == 0 {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			start, end = ranges[0].Start, ranges[0].End
+			statusCode = http.StatusPartialContent
+		}
+	}
+
+	for key, values := range sp.Headers {
+		if isHopByHopHeader(key) {
+			continue
+		}
+		w.Header().Set(key, strings.Join(values, ","))
+	}
+	w.Header().Del("Content-Range")
+	w.Header().Del("Content-Length")
+	w.Header().Del("Transfer-Encoding")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Cache-Control", "public, max-age=31536000")
+	switch {
+	case statusCode == http.StatusPartialContent:
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	case total >= 0:
+		end = total - 1
+		w.Header().Set("Content-Length", strconv.FormatInt(total, 10))
+	}
+	w.WriteHeader(statusCode)
+	if req.Method == http.MethodHead {
+		return
+	}
+
+	buf := make([]byte, 64*1024)
+	offset := start
+	for end < 0 || offset <= end {
+		available, err := sp.waitFor(ctx, offset)
+		if err != nil {
+			return
+		}
+		if available <= offset {
+			// 下载已结束
+			if end >= 0 {
+				log.Warnf("落盘文件 %v 在 %d 字节处提前结束", redactURL(sp.URL), available)
+			}
+			return
+		}
+		size := available - offset
+		if end >= 0 && size > end-offset+1 {
+			size = end - offset + 1
+		}
+		if size > int64(len(buf)) {
+			size = int64(len(buf))
+		}
+		n, err := sp.file.ReadAt(buf[:size], offset)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return
+			}
+			metricBytesOut.Add(float64(n))
+			offset += int64(n)
+		}
+		if err != nil && err != io.EOF {
+			log.Errorf("读取落盘文件 %s 失败: %v", sp.Path, err)
+			return
+		}
+	}
+}
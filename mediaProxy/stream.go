@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var contentRangePattern = regexp.MustCompile(`^bytes +([0-9]+)-([0-9]+)/([0-9]+|\*)$`)
+
+// errBadContentRange 上游返回了无法解析的 Content-Range
+var errBadContentRange = errors.New("无效的 Content-Range")
+
+// parseContentRange 解析 "bytes 0-1023/4096"，总大小未知 ("bytes 0-1023/*") 时 total 为 -1
+func parseContentRange(s string) (start int64, end int64, total int64, err error) {
+	m := contentRangePattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, 0, 0, fmt.Errorf("%w: %q", errBadContentRange, s)
+	}
+	start, _ = strconv.ParseInt(m[1], 10, 64)
+	end, _ = strconv.ParseInt(m[2], 10, 64)
+	total = -1
+	if m[3] != "*" {
+		total, _ = strconv.ParseInt(m[3], 10, 64)
+	}
+	if end < start || (total >= 0 && end >= total) {
+		return 0, 0, 0, fmt.Errorf("%w: %q", errBadContentRange, s)
+	}
+	return start, end, total, nil
+}
+
+// trackedWriter 记录写入客户端时的错误，用于区分客户端断开和上游中断
+type trackedWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (t *trackedWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if err != nil {
+		t.err = err
+	}
+	return n, err
+}
+
+// serveUnknownSize 上游支持 Range 但总大小未知 (Content-Range: bytes 0-1023/*) 时单连接顺序转发：
+// 响应不带 Content-Length，以 chunked 方式发给客户端；上游连接中断时从已发送的位置用 Range 续传。
+// 总大小未知时无法计算后缀范围和多范围，这两种情况忽略 Range 返回完整内容
+func serveUnknownSize(ctx context.Context, w http.ResponseWriter, req *http.Request, cfg *Config, url string,
+	upstreamHeader http.Header, jar *cookiejar.Jar, responseHeaders http.Header, requestRange string) {
+	log := requestLogger(ctx)
+	start, end := int64(0), int64(-1)
+	ranged := false
+	if specs := parseRangeHeader(requestRange); len(specs) == 1 && !specs[0].Suffix {
+		start, end, ranged = specs[0].Start, specs[0].End, true
+	}
+
+	client := cfg.clients.NewHttpClient()
+	client.Jar = jar
+	// 首次请求需要尽快响应客户端，熔断时直接返回 503；续传时等待冷却结束
+	fetch := func(offset int64, wait bool) (*http.Response, error) {
+		upstreamReq, err := http.NewRequestWithContext(withClientTrace(ctx), http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range upstreamHeader {
+			upstreamReq.Header[name] = values
+		}
+		rangeStr := fmt.Sprintf("bytes=%d-", offset)
+		if end >= 0 {
+			rangeStr += strconv.FormatInt(end, 10)
+		}
+		upstreamReq.Header.Set("Range", rangeStr)
+		return hostLimits.do(ctx, cfg, client, upstreamReq, wait)
+	}
+
+	resp, err := fetch(start, false)
+	if err != nil {
+		log.Errorf("请求 %v 失败: %v", redactURL(url), redactError(err))
+		if writeCircuitOpen(w, err) {
+			return
+		}
+		http.Error(w, fmt.Sprintf("下载 %v 链接失败: %v", redactURL(url), redactError(err)), http.StatusBadGateway)
+		return
+	}
+
+	// 根据首个响应确定返回给客户端的状态
+	statusCode := http.StatusOK
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		respStart, _, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || respStart != start {
+			resp.Body.Close()
+			log.Warnf("%v 返回的 Content-Range 无效: %q", redactURL(url), resp.Header.Get("Content-Range"))
+			http.Error(w, "上游返回的 Content-Range 无效", http.StatusBadGateway)
+			return
+		}
+		if ranged {
+			statusCode = http.StatusPartialContent
+		}
+	case http.StatusOK:
+		// 上游忽略了 Range，只能从头顺序转发，无法续传
+		start, end = 0, -1
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	default:
+		resp.Body.Close()
+		log.Warnf("请求 %v 失败, statusCode: %d", redactURL(url), resp.StatusCode)
+		http.Error(w, resp.Status, resp.StatusCode)
+		return
+	}
+	resumable := resp.StatusCode == http.StatusPartialContent
+
+	for key, values := range responseHeaders {
+		if isHopByHopHeader(key) {
+			continue
+		}
+		w.Header().Set(key, strings.Join(values, ","))
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Del("Content-Range")
+	w.Header().Del("Content-Encoding")
+	w.Header().Del("Transfer-Encoding")
+	if statusCode == http.StatusPartialContent {
+		w.Header().Set("Content-Range", resp.Header.Get("Content-Range"))
+	}
+	if resumable {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+	w.WriteHeader(statusCode)
+	if req.Method == http.MethodHead {
+		resp.Body.Close()
+		return
+	}
+
+	out := &trackedWriter{w: w}
+	buf := make([]byte, 32*1024)
+	offset := start
+	failures := 0
+	for {
+		n, err := io.CopyBuffer(out, resp.Body, buf)
+		resp.Body.Close()
+		offset += n
+		metricBytesIn.Add(float64(n))
+		metricBytesOut.Add(float64(n))
+		if out.err != nil || err == nil {
+			// 客户端断开或上游正常结束
+			return
+		}
+		if end >= 0 && offset > end {
+			return
+		}
+		if !resumable {
+			log.Warnf("%v 的连接中断且不支持续传, 已发送 %d 字节: %v", redactURL(url), offset-start, redactError(err))
+			return
+		}
+		if n > 0 {
+			failures = 0
+		}
+		if failures++; failures > cfg.MaxRetries {
+			log.Errorf("%v 续传失败次数过多, 已发送 %d 字节: %v", redactURL(url), offset-start, redactError(err))
+			return
+		}
+		log.Debugf("%v 的连接在 %d 处中断，续传: %v", redactURL(url), offset, redactError(err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+		if resp, err = fetch(offset, true); err != nil {
+			log.Errorf("续传 %v 失败: %v", redactURL(url), redactError(err))
+			return
+		}
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// 中断时恰好已经发送完毕
+			resp.Body.Close()
+			return
+		}
+		respStart, _, _, crErr := parseContentRange(resp.Header.Get("Content-Range"))
+		if resp.StatusCode != http.StatusPartialContent || crErr != nil || respStart != offset {
+			resp.Body.Close()
+			log.Errorf("续传 %v 失败: statusCode %d, Content-Range %q", redactURL(url), resp.StatusCode, resp.Header.Get("Content-Range"))
+			return
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		start, end int64
+		total      int64
+		wantErr    bool
+	}{
+		{header: "bytes 0-1023/4096", start: 0, end: 1023, total: 4096},
+		{header: "bytes 4095-4095/4096", start: 4095, end: 4095, total: 4096},
+		{header: "  bytes 100-199/1000 ", start: 100, end: 199, total: 1000},
+		{header: "bytes 0-1023/*", start: 0, end: 1023, total: -1},
+		{header: "bytes */4096", wantErr: true},
+		{header: "bytes 0-4096/4096", wantErr: true},
+		{header: "bytes 200-100/1000", wantErr: true},
+		{header: "bytes 0-/1000", wantErr: true},
+		{header: "bytes -100/1000", wantErr: true},
+		{header: "items 0-99/1000", wantErr: true},
+		{header: "0-99/1000", wantErr: true},
+		{header: "bytes 0-99/abc", wantErr: true},
+		{header: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			start, end, total, err := parseContentRange(tt.header)
+			if tt.wantErr {
+				if !errors.Is(err, errBadContentRange) {
+					t.Errorf("parseContentRange(%q) err = %v, want errBadContentRange", tt.header, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseContentRange(%q) err = %v", tt.header, err)
+			}
+			if start != tt.start || end != tt.end || total != tt.total {
+				t.Errorf("parseContentRange(%q) = %d, %d, %d, want %d, %d, %d", tt.header, start, end, total, tt.start, tt.end, tt.total)
+			}
+		})
+	}
+}
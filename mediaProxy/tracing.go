@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	handleUrl "net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracer 每次从全局 TracerProvider 获取，热重载切换 provider 后立即生效；
+// 未配置 trace-endpoint 时为空实现，span 不会被记录，几乎没有开销
+func tracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer("MediaProxy")
+}
+
+// blockedWriteThreshold emitter 写入阻塞超过该时长时才记录 span，避免每个分片都产生一个写入 span
+const blockedWriteThreshold = 50 * time.Millisecond
+
+type traceSettings struct {
+	Endpoint   string
+	SampleRate float64
+}
+
+var (
+	currentTraceSettings traceSettings
+	currentTraceProvider *sdktrace.TracerProvider
+)
+
+func init() {
+	// 只从客户端请求中提取 traceparent，不向上游注入，避免把链路信息泄露给 CDN
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// traceEndpointURL 补全 collector 地址：缺省协议时使用 http，缺省路径时使用 /v1/traces
+func traceEndpointURL(endpoint string) (string, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := handleUrl.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("无效的 trace-endpoint 参数: %s", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return u.String(), nil
+}
+
+// prepareTracing 校验链路追踪配置并创建 provider，返回开启或关闭 OTLP 链路追踪的 apply，设置未变化时 apply 不做任何操作。
+// 创建的 provider 只能交给 apply 使用，调用方应把它放在最后一个可能失败的步骤
+func prepareTracing(s traceSettings) (apply func(), err error) {
+	if s == currentTraceSettings {
+		return func() {}, nil
+	}
+	var provider *sdktrace.TracerProvider
+	var endpoint string
+	if s.Endpoint != "" {
+		if endpoint, err = traceEndpointURL(s.Endpoint); err != nil {
+			return nil, err
+		}
+		if s.SampleRate < 0 || s.SampleRate > 1 {
+			return nil, fmt.Errorf("无效的 trace-sample 参数: %v (取值 0~1)", s.SampleRate)
+		}
+		exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+		if err != nil {
+			return nil, fmt.Errorf("创建 OTLP exporter 失败: %v", err)
+		}
+		res := resource.NewSchemaless(
+			attribute.String("service.name", "mediaProxy"),
+			attribute.String("service.version", AppVersion),
+		)
+		provider = sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithResource(res),
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(s.SampleRate))),
+		)
+	}
+
+	return func() {
+		if provider != nil {
+			otel.SetTracerProvider(provider)
+			logrus.Infof("已开启链路追踪，上报地址: %s, 采样率: %v", endpoint, s.SampleRate)
+		} else {
+			otel.SetTracerProvider(noop.NewTracerProvider())
+			if currentTraceProvider != nil {
+				logrus.Info("已关闭链路追踪")
+			}
+		}
+
+		old := currentTraceProvider
+		currentTraceSettings = s
+		currentTraceProvider = provider
+		if old != nil {
+			// 旧的 provider 在后台刷新剩余 span，不阻塞配置加载
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				old.Shutdown(ctx)
+			}()
+		}
+	}, nil
+}
+
+// shutdownTracing 退出前上报剩余的 span
+func shutdownTracing() {
+	if currentTraceProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	currentTraceProvider.Shutdown(ctx)
+}
+
+// startRequestSpan 为客户端请求创建根 span，客户端带有 traceparent 时作为其子 span
+func startRequestSpan(req *http.Request, name string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	attrs := []attribute.KeyValue{
+		attribute.String("http.method", req.Method),
+		attribute.String("http.range", req.Header.Get("Range")),
+		attribute.String("client.address", req.RemoteAddr),
+	}
+	if info := getRequestInfo(req.Context()); info != nil {
+		attrs = append(attrs, attribute.String("request_id", info.ID))
+	}
+	return tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// withClientTrace 把 DNS 解析、建立连接、TLS 握手和首字节等事件记录到当前 span 上
+func withClientTrace(ctx context.Context) context.Context {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			span.AddEvent("dns_start", trace.WithAttributes(attribute.String("host", info.Host)))
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			attrs := []attribute.KeyValue{attribute.Int("addrs", len(info.Addrs))}
+			if info.Err != nil {
+				attrs = append(attrs, attribute.String("error", info.Err.Error()))
+			}
+			span.AddEvent("dns_done", trace.WithAttributes(attrs...))
+		},
+		ConnectDone: func(network, addr string, err error) {
+			attrs := []attribute.KeyValue{attribute.String("addr", addr)}
+			if err != nil {
+				attrs = append(attrs, attribute.String("error", err.Error()))
+			}
+			span.AddEvent("connect_done", trace.WithAttributes(attrs...))
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			attrs := []attribute.KeyValue{attribute.String("alpn", state.NegotiatedProtocol)}
+			if err != nil {
+				attrs = append(attrs, attribute.String("error", err.Error()))
+			}
+			span.AddEvent("tls_handshake_done", trace.WithAttributes(attrs...))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			span.AddEvent("got_conn", trace.WithAttributes(attribute.Bool("reused", info.Reused)))
+		},
+		GotFirstResponseByte: func() {
+			span.AddEvent("first_byte")
+		},
+	})
+}
+
+// endSpan 结束 span，err 不为空时标记为失败
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// chunkTrace 记录分片每次请求尝试的 span，下一次尝试开始或分片结束时关闭上一次的 span
+type chunkTrace struct {
+	span trace.Span
+}
+
+func (t *chunkTrace) start(ctx context.Context, chunk *Chunk, attempt int) context.Context {
+	ctx, t.span = tracer().Start(ctx, "chunk", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.Int64("chunk.start", chunk.startOffset),
+		attribute.Int64("chunk.end", chunk.endOffset),
+		attribute.Int("chunk.attempt", attempt),
+	))
+	return withClientTrace(ctx)
+}
+
+func (t *chunkTrace) setResponse(statusCode int, bodySize int) {
+	if t.span == nil {
+		return
+	}
+	t.span.SetAttributes(
+		attribute.Int("http.status_code", statusCode),
+		attribute.Int("chunk.bytes", bodySize),
+	)
+}
+
+// end 结束当前尝试，retryReason 不为空表示这次尝试失败并将重试
+func (t *chunkTrace) end(retryReason string, err error) {
+	if t.span == nil {
+		return
+	}
+	if retryReason != "" {
+		t.span.SetAttributes(attribute.String("chunk.retry_reason", retryReason))
+		if err == nil {
+			t.span.SetStatus(codes.Error, retryReason)
+		}
+	}
+	endSpan(t.span, err)
+	t.span = nil
+}
+
+// traceBlockedWrite 向 emitter 写入阻塞超过阈值时补记一个 span，说明时间花在了等待客户端读取上
+func traceBlockedWrite(ctx context.Context, start time.Time, n int) {
+	end := time.Now()
+	if end.Sub(start) < blockedWriteThreshold || !trace.SpanFromContext(ctx).IsRecording() {
+		return
+	}
+	_, span := tracer().Start(ctx, "emitter.write", trace.WithTimestamp(start), trace.WithAttributes(
+		attribute.Int("bytes", n),
+	))
+	span.End(trace.WithTimestamp(end))
+}